@@ -0,0 +1,207 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	// ErrDispatcherClosed indicates the dispatcher doesn't accept more events
+	ErrDispatcherClosed = errors.New("dispatcher is closed")
+)
+
+// WithAsyncReduce makes the dispatcher acknowledge events as soon as they're
+// persisted, and reduce them in the background with a pool of workers. Events
+// of the same entity are always reduced in order by the same worker. Each worker
+// queues up to queueSize events; when a queue is full, dispatching blocks until
+// there's room for more. Use WaitFor to wait for reducers to catch up.
+func WithAsyncReduce(workers, queueSize int) DispatcherOption {
+	return func(d *Dispatcher) {
+		if workers < 1 {
+			workers = 1
+		}
+		d.async = newAsyncReducer(workers, queueSize, d.reduce, d.saveProgress)
+	}
+}
+
+type reduceJob struct {
+	seq      uint64
+	event    core.Event
+	reducers []*registration
+}
+
+// asyncReducer reduces events in the background, tracking which sequences
+// were already reduced.
+type asyncReducer struct {
+	queues   []chan reduceJob
+	reduce   func(regs []*registration, seq uint64, event core.Event) error
+	progress func(regs []*registration, seq uint64)
+	wg       sync.WaitGroup
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	last    uint64
+	mark    uint64
+	pending map[uint64]struct{}
+	// ends are the last sequences of the enqueued batches
+	ends []uint64
+}
+
+func newAsyncReducer(
+	workers, queueSize int,
+	reduce func([]*registration, uint64, core.Event) error,
+	progress func([]*registration, uint64),
+) *asyncReducer {
+	a := &asyncReducer{
+		queues:   make([]chan reduceJob, workers),
+		reduce:   reduce,
+		progress: progress,
+		pending:  make(map[uint64]struct{}),
+	}
+	a.cond = sync.NewCond(&a.lock)
+	for i := range a.queues {
+		a.queues[i] = make(chan reduceJob, queueSize)
+		a.wg.Add(1)
+		go a.work(a.queues[i])
+	}
+	return a
+}
+
+// observe records seq as persisted. Persisted events which aren't
+// enqueued are considered reduced.
+func (a *asyncReducer) observe(seq uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if seq > a.last {
+		a.last = seq
+		a.cond.Broadcast()
+	}
+}
+
+// enqueue schedules jobs for reduction, blocking if the queues are full.
+func (a *asyncReducer) enqueue(jobs []reduceJob) error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return ErrDispatcherClosed
+	}
+	for _, j := range jobs {
+		a.pending[j.seq] = struct{}{}
+		if j.seq > a.last {
+			a.last = j.seq
+		}
+		for _, r := range j.reducers {
+			r.enqueued(j.seq)
+		}
+	}
+	if len(jobs) > 0 {
+		a.ends = append(a.ends, jobs[len(jobs)-1].seq)
+	}
+	a.lock.Unlock()
+
+	for _, j := range jobs {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(j.event.EntityID()))
+		a.queues[h.Sum32()%uint32(len(a.queues))] <- j
+	}
+	return nil
+}
+
+func (a *asyncReducer) work(queue <-chan reduceJob) {
+	defer a.wg.Done()
+	for j := range queue {
+		if err := a.reduce(j.reducers, j.seq, j.event); err != nil {
+			log.Errorf("error when reducing event %d: %v", j.seq, err)
+		}
+		a.lock.Lock()
+		delete(a.pending, j.seq)
+		// Every event up to the lowest pending one was reduced
+		watermark := a.last
+		for p := range a.pending {
+			if p <= watermark {
+				watermark = p - 1
+			}
+		}
+		if watermark > a.mark {
+			a.mark = watermark
+			// Reducers are checkpointed once per batch
+			var done bool
+			for len(a.ends) > 0 && a.ends[0] <= watermark {
+				a.ends, done = a.ends[1:], true
+			}
+			if done {
+				a.progress(j.reducers, watermark)
+			}
+		}
+		a.cond.Broadcast()
+		a.lock.Unlock()
+	}
+}
+
+// waitFor blocks until every event up to seq was reduced, or ctx is done.
+func (a *asyncReducer) waitFor(ctx context.Context, seq uint64) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.lock.Lock()
+			a.cond.Broadcast()
+			a.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for !a.reduced(seq) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if a.closed {
+			return ErrDispatcherClosed
+		}
+		a.cond.Wait()
+	}
+	return nil
+}
+
+// watermark returns the sequence up to which every event was reduced.
+func (a *asyncReducer) watermark() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.mark
+}
+
+func (a *asyncReducer) reduced(seq uint64) bool {
+	if seq > a.last {
+		return false
+	}
+	for p := range a.pending {
+		if p <= seq {
+			return false
+		}
+	}
+	return true
+}
+
+// close stops accepting events, and waits for queued ones to be reduced.
+func (a *asyncReducer) close() {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	a.cond.Broadcast()
+	a.lock.Unlock()
+	for _, q := range a.queues {
+		close(q)
+	}
+	a.wg.Wait()
+}
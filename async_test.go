@@ -0,0 +1,143 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+)
+
+func TestAsyncDispatch(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore(), WithAsyncReduce(2, 10))
+	defer dispatcher.Close()
+	reducer := newBlockingReducer()
+	dispatcher.Register(reducer)
+
+	if err := dispatcher.Dispatch(core.NewNullEvent(time.Now())); err != nil {
+		t.Fatalf("unexpected error in dispatch call: %v", err)
+	}
+	seq, err := dispatcher.LastSeq()
+	checkErr(t, err)
+	if seq != 1 {
+		t.Fatalf("expected seq 1, got %d", seq)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := dispatcher.WaitFor(ctx, seq); err != context.DeadlineExceeded {
+		t.Fatalf("reducer is blocked, expected deadline exceeded error, got: %v", err)
+	}
+	close(reducer.release)
+	checkErr(t, dispatcher.WaitFor(context.Background(), seq))
+	if len(reducer.reduced) != 1 {
+		t.Fatal("event should have been reduced")
+	}
+}
+
+func TestAsyncBackpressure(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore(), WithAsyncReduce(1, 1))
+	defer dispatcher.Close()
+	reducer := newBlockingReducer()
+	dispatcher.Register(reducer)
+
+	// First event is taken by the worker, second one fills the queue
+	now := time.Now()
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now)))
+	<-reducer.started
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(1))))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := dispatcher.Dispatch(core.NewNullEvent(now.Add(2))); err != nil {
+			t.Errorf("unexpected error in dispatch call: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("dispatch should block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(reducer.release)
+	<-done
+	checkErr(t, dispatcher.WaitFor(context.Background(), 3))
+	if len(reducer.reduced) != 3 {
+		t.Fatalf("expected 3 reduced events, got %d", len(reducer.reduced))
+	}
+	for i := range reducer.reduced {
+		if reducer.reduced[i] != core.NewNullEvent(now.Add(time.Duration(i))).Time()[7] {
+			t.Fatal("events of the same entity should be reduced in order")
+		}
+	}
+}
+
+func TestAsyncStore(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore(), WithAsyncReduce(4, 100))
+	defer dispatcher.Close()
+	store := NewStore(ds.NewMapDatastore(), dispatcher, jsonpatcher.New())
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+
+	var persons []*Person
+	for i := 0; i < 50; i++ {
+		p := &Person{Name: "Foo", Age: i}
+		checkErr(t, m.Create(p))
+		persons = append(persons, p)
+	}
+	seq, err := dispatcher.LastSeq()
+	checkErr(t, err)
+	checkErr(t, dispatcher.WaitFor(context.Background(), seq))
+	for _, p := range persons {
+		assertPersonInModel(t, m, p)
+	}
+}
+
+func TestAsyncStoreWriteTxn(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore(), WithAsyncReduce(4, 100))
+	defer dispatcher.Close()
+	store := NewStore(ds.NewMapDatastore(), dispatcher, jsonpatcher.New())
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+
+	// Each transaction must see the instance written by the previous one
+	for i := 0; i < 20; i++ {
+		p := &Person{Name: "Foo", Age: 0}
+		checkErr(t, m.Create(p))
+		p.Age = 1
+		checkErr(t, m.Save(p))
+		p.Age = 2
+		checkErr(t, m.Save(p))
+
+		seq, err := dispatcher.LastSeq()
+		checkErr(t, err)
+		checkErr(t, dispatcher.WaitFor(context.Background(), seq))
+		assertPersonInModel(t, m, p)
+	}
+}
+
+type blockingReducer struct {
+	started chan struct{}
+	release chan struct{}
+	reduced []byte
+}
+
+func newBlockingReducer() *blockingReducer {
+	return &blockingReducer{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (r *blockingReducer) Reduce(e core.Event) error {
+	r.started <- struct{}{}
+	<-r.release
+	r.reduced = append(r.reduced, e.Time()[7])
+	return nil
+}
@@ -0,0 +1,214 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	datastore "github.com/ipfs/go-datastore"
+)
+
+var (
+	checkpointsPrefix = datastore.NewKey("/checkpoints")
+)
+
+// Checkpoint returns the sequence of the last event reduced by the reducer
+// registered with name. Zero means it didn't reduce any event yet.
+func (d *Dispatcher) Checkpoint(name string) (uint64, error) {
+	return d.loadCheckpoint(name)
+}
+
+// catchUp reduces with r every persisted event after its checkpoint.
+func (d *Dispatcher) catchUp(r *registration) error {
+	if err := d.loadHead(); err != nil {
+		return err
+	}
+	cp, err := d.loadCheckpoint(r.name)
+	if err != nil {
+		return err
+	}
+	if cp == 0 && r.legacy {
+		cp = d.migrated
+	}
+	r.lock.Lock()
+	r.checkpoint = cp
+	r.lock.Unlock()
+	if cp >= d.seq {
+		return nil
+	}
+	log.Debugf("catching up reducer %s from %d to %d", r.name, cp, d.seq)
+	entries, err := d.events(context.Background(), cp+1, d.seq, nil)
+	if err != nil {
+		return err
+	}
+	var reduced uint64
+	for _, e := range entries {
+		if r.policy == nil {
+			err = r.reducer.Reduce(e.Event)
+		} else {
+			err = d.reduceWithRetry(r, e.Seq, e.Event)
+		}
+		if err != nil {
+			r.fail(e.Seq)
+			err = fmt.Errorf("error when catching up reducer %s at %d: %v", r.name, e.Seq, err)
+			break
+		}
+		reduced = e.Seq
+	}
+	if cerr := d.saveCheckpoint(r, reduced); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replay resets the checkpoint of the reducer registered with name, runs
+// reset, and reduces again every persisted event with it.
+func (d *Dispatcher) replay(name string, reset func() error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var reg *registration
+	for _, r := range d.reducers {
+		if r.name == name {
+			reg = r
+			break
+		}
+	}
+	if reg == nil {
+		return ErrUnknownReducer
+	}
+	if d.async != nil {
+		// Queued events must not be reduced while replaying
+		if err := d.loadHead(); err != nil {
+			return err
+		}
+		if err := d.async.waitFor(context.Background(), d.seq); err != nil {
+			return err
+		}
+	}
+	if err := d.store.Delete(checkpointsPrefix.ChildString(name)); err != nil {
+		return err
+	}
+	if err := reset(); err != nil {
+		return err
+	}
+	return d.catchUp(reg)
+}
+
+// saveCheckpoint records seq as reduced by r.
+func (d *Dispatcher) saveCheckpoint(r *registration, seq uint64) error {
+	return d.saveCheckpoints([]*registration{r}, seq)
+}
+
+// saveCheckpoints records seq as reduced by every reducer in regs, in a
+// single write. Checkpoints only advance, and never past an event which
+// a reducer failed to reduce, unless it was stored as a dead letter.
+func (d *Dispatcher) saveCheckpoints(regs []*registration, seq uint64) error {
+	d.cplock.Lock()
+	defer d.cplock.Unlock()
+	cps := make(map[*registration]uint64)
+	for _, r := range regs {
+		r.lock.Lock()
+		if cp := r.limit(seq); cp > r.checkpoint {
+			cps[r] = cp
+		}
+		r.lock.Unlock()
+	}
+	if len(cps) == 0 {
+		return nil
+	}
+	w, discard, err := d.newWriter()
+	if err != nil {
+		return err
+	}
+	defer discard()
+	for r, cp := range cps {
+		key := checkpointsPrefix.ChildString(r.name)
+		if err := w.Put(key, []byte(strconv.FormatUint(cp, 10))); err != nil {
+			return err
+		}
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	for r, cp := range cps {
+		r.lock.Lock()
+		if cp > r.checkpoint {
+			r.checkpoint = cp
+		}
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+// saveProgress is saveCheckpoints for asynchronous reducers, which have
+// nobody to return errors to.
+func (d *Dispatcher) saveProgress(regs []*registration, seq uint64) {
+	if err := d.saveCheckpoints(regs, seq); err != nil {
+		log.Errorf("error when saving checkpoints at %d: %v", seq, err)
+	}
+}
+
+// limit returns the highest sequence up to seq r can be checkpointed with:
+// the one before the first event it failed to reduce, or is retrying.
+// It must be called with r.lock held.
+func (r *registration) limit(seq uint64) uint64 {
+	if r.failed != 0 && seq >= r.failed {
+		seq = r.failed - 1
+	}
+	if len(r.backlog) > 0 && seq >= r.backlog[0].seq {
+		seq = r.backlog[0].seq - 1
+	}
+	return seq
+}
+
+// enqueued records the event seq is waiting to be reduced by r.
+func (r *registration) enqueued(seq uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[uint64]struct{})
+	}
+	r.pending[seq] = struct{}{}
+}
+
+// reduced records r is done with the event seq, even if it failed.
+func (r *registration) reduced(seq uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.pending, seq)
+}
+
+// busy returns true if an event up to seq is waiting to be reduced by r,
+// or retried. It must be called with r.lock held.
+func (r *registration) busy(seq uint64) bool {
+	if len(r.backlog) > 0 && r.backlog[0].seq <= seq {
+		return true
+	}
+	for p := range r.pending {
+		if p <= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records r failed to reduce the event seq, which isn't stored as
+// a dead letter, so it's reduced again once r is registered again.
+func (r *registration) fail(seq uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failed == 0 || seq < r.failed {
+		r.failed = seq
+	}
+}
+
+func (d *Dispatcher) loadCheckpoint(name string) (uint64, error) {
+	b, err := d.store.Get(checkpointsPrefix.ChildString(name))
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
@@ -0,0 +1,223 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestCheckpoints(t *testing.T) {
+	t.Parallel()
+	eventstore := NewTxMapDatastore()
+	dispatcher := NewDispatcher(eventstore)
+	a := &orderReducer{}
+	checkErr(t, dispatcher.Register(a, WithReducerName("a")))
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))))
+	}
+	assertCheckpoint(t, dispatcher, "a", 3)
+
+	t.Run("NewReducer", func(t *testing.T) {
+		b := &orderReducer{}
+		checkErr(t, dispatcher.Register(b, WithReducerName("b")))
+		if len(b.events) != 3 {
+			t.Fatalf("new reducer should catch up 3 events, got %d", len(b.events))
+		}
+		assertCheckpoint(t, dispatcher, "b", 3)
+	})
+	t.Run("Restart", func(t *testing.T) {
+		// Events persisted while "a" isn't registered
+		other := NewDispatcher(eventstore)
+		for i := 3; i < 5; i++ {
+			checkErr(t, other.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))))
+		}
+
+		restarted := NewDispatcher(eventstore)
+		a := &orderReducer{}
+		checkErr(t, restarted.Register(a, WithReducerName("a")))
+		if len(a.events) != 2 {
+			t.Fatalf("restarted reducer should only catch up 2 events, got %d", len(a.events))
+		}
+		assertCheckpoint(t, restarted, "a", 5)
+	})
+	t.Run("FailedCatchUp", func(t *testing.T) {
+		if err := dispatcher.Register(&errorReducer{}, WithReducerName("error")); err == nil {
+			t.Fatal("failed catch up should return an error")
+		}
+		assertCheckpoint(t, dispatcher, "error", 0)
+	})
+}
+
+func TestModelCatchUp(t *testing.T) {
+	t.Parallel()
+	source := createTestStore()
+	m, err := source.Register("Person", &Person{})
+	checkErr(t, err)
+	rec := &recorderReducer{}
+	checkErr(t, source.dispatcher.Register(rec))
+	p1, p2 := &Person{Name: "Foo", Age: 42}, &Person{Name: "Bar", Age: 43}
+	checkErr(t, m.Create(p1, p2))
+
+	// Events received before the model is registered are reduced on registration
+	target := createTestStore()
+	_, err = target.DispatchBatch(rec.events)
+	checkErr(t, err)
+	tm, err := target.Register("Person", &Person{})
+	checkErr(t, err)
+	assertPersonInModel(t, tm, p1)
+	assertPersonInModel(t, tm, p2)
+	assertCheckpoint(t, target.dispatcher, "Person", 2)
+}
+
+func TestAsyncCheckpoints(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore(), WithAsyncReduce(4, 10))
+	defer dispatcher.Close()
+	checkErr(t, dispatcher.Register(&nullReducer{}, WithReducerName("null")))
+	for i := 0; i < 20; i++ {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(time.Now())))
+		time.Sleep(time.Microsecond)
+	}
+	seq, err := dispatcher.LastSeq()
+	checkErr(t, err)
+	checkErr(t, dispatcher.WaitFor(context.Background(), seq))
+	assertCheckpoint(t, dispatcher, "null", seq)
+}
+
+func TestFailedCheckpoints(t *testing.T) {
+	t.Parallel()
+	for _, async := range []bool{false, true} {
+		var opts []DispatcherOption
+		if async {
+			opts = append(opts, WithAsyncReduce(2, 10))
+		}
+		dispatcher := NewDispatcher(NewTxMapDatastore(), opts...)
+		defer dispatcher.Close()
+		checkErr(t, dispatcher.Register(&flakyReducer{failures: 1}, WithReducerName("failed")))
+		checkErr(t, dispatcher.Register(&flakyReducer{failures: 1}, WithReducerName("dead"),
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 1})))
+		checkErr(t, dispatcher.Register(&nullReducer{}, WithReducerName("null")))
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			err := dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i))))
+			if err != nil && (async || i != 0) {
+				t.Fatalf("unexpected error in dispatch call: %v", err)
+			}
+		}
+		checkErr(t, dispatcher.WaitFor(context.Background(), 3))
+
+		// Events which failed, and weren't dead lettered, are reduced
+		// again once the reducer is registered again
+		assertCheckpoint(t, dispatcher, "failed", 0)
+		assertCheckpoint(t, dispatcher, "dead", 3)
+		assertCheckpoint(t, dispatcher, "null", 3)
+	}
+}
+
+func TestBatchCheckpoints(t *testing.T) {
+	t.Parallel()
+	store := &countingDatastore{TxMapDatastore: NewTxMapDatastore()}
+	dispatcher := NewDispatcher(store)
+	checkErr(t, dispatcher.Register(&nullReducer{}, WithReducerName("a")))
+	checkErr(t, dispatcher.Register(&nullReducer{}, WithReducerName("b")))
+	now := time.Now()
+	events := make([]core.Event, 5)
+	for i := range events {
+		events[i] = core.NewNullEvent(now.Add(time.Duration(i)))
+	}
+	checkErr(t, dispatcher.DispatchBatch(events))
+	assertCheckpoint(t, dispatcher, "a", 5)
+	assertCheckpoint(t, dispatcher, "b", 5)
+	if store.writes != 2 {
+		t.Fatalf("expected a single write of the 2 checkpoints, got %d", store.writes)
+	}
+}
+
+func TestFailedReducerInBatch(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	failing, healthy := &failingAtReducer{at: 3}, &orderReducer{}
+	checkErr(t, dispatcher.Register(failing, WithReducerName("failing")))
+	checkErr(t, dispatcher.Register(healthy, WithReducerName("healthy")))
+	now := time.Now()
+	events := make([]core.Event, 4)
+	for i := range events {
+		events[i] = core.NewNullEvent(now.Add(time.Duration(i)))
+	}
+	if err := dispatcher.DispatchBatch(events); err != errFlaky {
+		t.Fatalf("expected reducer error, got: %v", err)
+	}
+
+	// Reducers which didn't fail reduce the whole batch
+	if len(healthy.events) != 4 {
+		t.Fatalf("healthy reducer should reduce every event, got %d", len(healthy.events))
+	}
+	if failing.calls != 3 {
+		t.Fatalf("failed reducer should skip the rest of the batch, got %d calls", failing.calls)
+	}
+	assertCheckpoint(t, dispatcher, "failing", 2)
+	assertCheckpoint(t, dispatcher, "healthy", 4)
+
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Hour))))
+	assertCheckpoint(t, dispatcher, "failing", 2)
+	assertCheckpoint(t, dispatcher, "healthy", 5)
+}
+
+// failingAtReducer fails to reduce its call number at.
+type failingAtReducer struct {
+	at    int
+	calls int
+}
+
+func (r *failingAtReducer) Reduce(core.Event) error {
+	r.calls++
+	if r.calls == r.at {
+		return errFlaky
+	}
+	return nil
+}
+
+// countingDatastore counts the writes of checkpoints.
+type countingDatastore struct {
+	*TxMapDatastore
+	writes int
+}
+
+func (d *countingDatastore) Put(key datastore.Key, value []byte) error {
+	d.count(key)
+	return d.TxMapDatastore.Put(key, value)
+}
+
+func (d *countingDatastore) Batch() (datastore.Batch, error) {
+	b, err := d.TxMapDatastore.Batch()
+	return &countingBatch{Batch: b, d: d}, err
+}
+
+func (d *countingDatastore) count(key datastore.Key) {
+	if checkpointsPrefix.IsAncestorOf(key) {
+		d.writes++
+	}
+}
+
+type countingBatch struct {
+	datastore.Batch
+	d *countingDatastore
+}
+
+func (b *countingBatch) Put(key datastore.Key, value []byte) error {
+	b.d.count(key)
+	return b.Batch.Put(key, value)
+}
+
+func assertCheckpoint(t *testing.T, d *Dispatcher, name string, seq uint64) {
+	t.Helper()
+	cp, err := d.Checkpoint(name)
+	checkErr(t, err)
+	if cp != seq {
+		t.Fatalf("expected checkpoint of %s at %d, got %d", name, seq, cp)
+	}
+}
@@ -2,6 +2,8 @@ package eventstore
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,31 +12,14 @@ import (
 	"github.com/textileio/go-eventstore/core"
 )
 
-// TxMapDatastore does stuff...
-type TxMapDatastore struct {
-	*datastore.MapDatastore
-	lock sync.RWMutex
-}
-
-func NewTxMapDatastore() *TxMapDatastore {
-	return &TxMapDatastore{
-		MapDatastore: datastore.NewMapDatastore(),
-	}
-}
-
-func (d *TxMapDatastore) NewTransaction(readOnly bool) (datastore.Txn, error) {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-	return NewSimpleTx(d), nil
-}
-
 type op struct {
 	delete bool
 	value  []byte
 }
 
 // SimpleTx implements the transaction interface for datastores who do
-// not have any sort of underlying transactional support
+// not have any sort of underlying transactional support. Writes are kept
+// until Commit, and reads see them on top of the target.
 type SimpleTx struct {
 	ops    map[datastore.Key]op
 	lock   sync.RWMutex
@@ -51,63 +36,129 @@ func NewSimpleTx(ds datastore.Datastore) datastore.Txn {
 func (bt *SimpleTx) Query(q query.Query) (query.Results, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
-	return bt.target.Query(q)
+	if len(bt.ops) == 0 {
+		return bt.target.Query(q)
+	}
+	// Pending writes are merged with the target entries, and the query
+	// is applied over the result
+	res, err := bt.target.Query(query.Query{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	merged := make([]query.Entry, 0, len(entries)+len(bt.ops))
+	for _, e := range entries {
+		if _, ok := bt.ops[datastore.NewKey(e.Key)]; !ok {
+			merged = append(merged, e)
+		}
+	}
+	for k, op := range bt.ops {
+		if !op.delete {
+			merged = append(merged, query.Entry{Key: k.String(), Value: op.value})
+		}
+	}
+	if q.KeysOnly {
+		for i := range merged {
+			merged[i].Value = nil
+		}
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, merged)), nil
 }
 
 func (bt *SimpleTx) Get(k datastore.Key) ([]byte, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		if op.delete {
+			return nil, datastore.ErrNotFound
+		}
+		return op.value, nil
+	}
 	return bt.target.Get(k)
 }
 
 func (bt *SimpleTx) Has(k datastore.Key) (bool, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		return !op.delete, nil
+	}
 	return bt.target.Has(k)
 }
 
 func (bt *SimpleTx) GetSize(k datastore.Key) (int, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		if op.delete {
+			return -1, datastore.ErrNotFound
+		}
+		return len(op.value), nil
+	}
 	return bt.target.GetSize(k)
 }
 
 func (bt *SimpleTx) Put(key datastore.Key, val []byte) error {
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
 	bt.ops[key] = op{value: val}
 	return nil
 }
 
 func (bt *SimpleTx) Delete(key datastore.Key) error {
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
 	bt.ops[key] = op{delete: true}
 	return nil
 }
 
 func (bt *SimpleTx) Discard() {
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	bt.ops = make(map[datastore.Key]op)
 }
 
+// Commit applies the pending writes to the target, in key order. If a
+// write fails, the ones already applied are rolled back, so the target is
+// left as it was unless rolling back fails too.
 func (bt *SimpleTx) Commit() error {
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	var err error
-	for k, op := range bt.ops {
-		if op.delete {
-			err = bt.target.Delete(k)
-		} else {
-			err = bt.target.Put(k, op.value)
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	keys := make([]datastore.Key, 0, len(bt.ops))
+	for k := range bt.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	previous := make([]op, 0, len(keys))
+	for _, k := range keys {
+		prev, err := bt.target.Get(k)
+		if err != nil && err != datastore.ErrNotFound {
+			return err
 		}
-		if err != nil {
-			break
+		previous = append(previous, op{delete: err == datastore.ErrNotFound, value: prev})
+	}
+	for i, k := range keys {
+		if err := applyOp(bt.target, k, bt.ops[k]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if rerr := applyOp(bt.target, keys[j], previous[j]); rerr != nil {
+					return fmt.Errorf("error when rolling back after %v: %v", err, rerr)
+				}
+			}
+			return err
 		}
 	}
+	bt.ops = make(map[datastore.Key]op)
+	return nil
+}
 
-	return err
+func applyOp(w datastore.Write, k datastore.Key, o op) error {
+	if o.delete {
+		return w.Delete(k)
+	}
+	return w.Put(k, o.value)
 }
 
 type nullReducer struct{}
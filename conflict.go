@@ -0,0 +1,230 @@
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	versionsPrefix = ds.NewKey("/versions")
+	replicaIDKey   = ds.NewKey("/replica")
+)
+
+// Conflict is an instance updated concurrently by an event and by
+// changes already reduced, which didn't know about each other.
+type Conflict struct {
+	EntityID core.EntityID
+	// Local is the JSON encoded instance, nil if it doesn't exist
+	Local []byte
+	// Remote is the JSON encoded instance as the event would leave it
+	// applied over Local, nil if it deletes it. Events which can't be
+	// applied over Local fail to reduce instead of being resolved.
+	Remote []byte
+	// LocalTime is the time of the last change already reduced
+	LocalTime core.Timestamp
+	// RemoteTime is the time of the event
+	RemoteTime core.Timestamp
+}
+
+// ConflictResolver returns the JSON encoded instance resolving c,
+// or nil if the instance should be deleted.
+type ConflictResolver func(c Conflict) ([]byte, error)
+
+// MergeFields resolves conflicts applying the fields changed by the
+// concurrent event over the local instance. It's the default resolver.
+// When both changes touch the same fields, replicas may not converge.
+func MergeFields(c Conflict) ([]byte, error) {
+	return c.Remote, nil
+}
+
+// LastWriterWins resolves conflicts keeping the instance changed last.
+// Ties are broken comparing the instances, so every replica keeps the same one.
+func LastWriterWins(c Conflict) ([]byte, error) {
+	switch c.RemoteTime.Compare(c.LocalTime) {
+	case 1:
+		return c.Remote, nil
+	case -1:
+		return c.Local, nil
+	}
+	if bytes.Compare(c.Remote, c.Local) > 0 {
+		return c.Remote, nil
+	}
+	return c.Local, nil
+}
+
+// ModelOption configures optional behavior of a Model.
+type ModelOption func(*Model)
+
+// WithConflictResolver sets how the model resolves concurrent updates of an instance.
+func WithConflictResolver(r ConflictResolver) ModelOption {
+	return func(m *Model) {
+		m.resolver = r
+	}
+}
+
+// WithModelRetryPolicy makes the dispatcher retry the failed reductions of
+// the model following p, see WithRetryPolicy. Write transactions of the
+// model wait for its retries, so they see every persisted event.
+func WithModelRetryPolicy(p RetryPolicy) ModelOption {
+	return func(m *Model) {
+		m.policy = &p
+	}
+}
+
+// WithReplicaID sets the ID identifying the store changes in vector clocks.
+// By default, a random ID is generated and persisted in the store datastore.
+func WithReplicaID(id string) StoreOption {
+	return func(s *Store) {
+		s.replicaID = id
+	}
+}
+
+// ReplicaID returns the ID identifying the store changes in vector clocks.
+func (s *Store) ReplicaID() (string, error) {
+	s.replicaLock.Lock()
+	defer s.replicaLock.Unlock()
+	if s.replicaID != "" {
+		return s.replicaID, nil
+	}
+	b, err := s.datastore.Get(replicaIDKey)
+	if err == ds.ErrNotFound {
+		b = []byte(core.NewEventID())
+		err = s.datastore.Put(replicaIDKey, b)
+	}
+	if err != nil {
+		return "", err
+	}
+	s.replicaID = string(b)
+	return s.replicaID, nil
+}
+
+// entityVersion is the vector clock of an instance, and the time of its
+// last change. It's kept after the instance is deleted, to detect
+// concurrent updates of deleted instances.
+type entityVersion struct {
+	Clock core.VectorClock
+	Time  []byte
+}
+
+// nextVersion returns the vector clock for a new local change of id.
+// Clocks are tracked as they're issued, since the changes of a transaction
+// are reduced after they're all issued, until releaseVersions is called.
+func (m *Model) nextVersion(id core.EntityID, replica string) (core.VectorClock, error) {
+	current, err := m.loadVersion(m.datastore, m.dsKey, id)
+	if err != nil {
+		return nil, err
+	}
+	m.issuedLock.Lock()
+	defer m.issuedLock.Unlock()
+	v := current.Clock.Merge(m.issued[id]).Increment(replica)
+	m.issued[id] = v
+	return v, nil
+}
+
+// releaseVersions stops tracking the clocks issued for ids, once their
+// events are persisted and reduced, or failed to be.
+func (m *Model) releaseVersions(ids []core.EntityID) {
+	m.issuedLock.Lock()
+	defer m.issuedLock.Unlock()
+	for _, id := range ids {
+		delete(m.issued, id)
+	}
+}
+
+// reduceVersioned reduces event according to how its version is related
+// to the instance one, kept under baseKey. Events already seen are ignored,
+// and concurrent ones are resolved with the model ConflictResolver.
+func (m *Model) reduceVersioned(event core.Event, txn ds.Txn, baseKey ds.Key) error {
+	id := event.EntityID()
+	version := event.Metadata().Version
+	current, err := m.loadVersion(txn, baseKey, id)
+	if err != nil {
+		return err
+	}
+	switch current.Clock.Compare(version) {
+	case core.After, core.Equal:
+		log.Debugf("ignoring event with version %v, instance %s is at %v", version, id, current.Clock)
+		return nil
+	case core.Before:
+		if err := m.reduceInto(event, txn, baseKey); err != nil {
+			return err
+		}
+	case core.Concurrent:
+		log.Debugf("concurrent update of instance %s at %v with version %v", id, current.Clock, version)
+		if err := m.resolve(event, current, txn, baseKey); err != nil {
+			return err
+		}
+	}
+	return m.saveVersion(txn, baseKey, id, current.next(event))
+}
+
+func (m *Model) resolve(event core.Event, current entityVersion, txn ds.Txn, baseKey ds.Key) error {
+	key := baseKey.ChildString(event.EntityID().String())
+	local, err := txn.Get(key)
+	if err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	resolved, err := m.resolveConflict(event, local, current)
+	if err != nil {
+		return err
+	}
+	if resolved == nil {
+		if local == nil {
+			return nil
+		}
+		return txn.Delete(key)
+	}
+	return txn.Put(key, resolved)
+}
+
+// resolveConflict returns the JSON encoded instance resolving the concurrent
+// event over local, or nil if it's deleted. Events which can't be applied
+// over local fail with an ErrInvalidEvent.
+func (m *Model) resolveConflict(event core.Event, local []byte, current entityVersion) ([]byte, error) {
+	remote, err := m.apply(event, local)
+	if err != nil {
+		return nil, &applyError{err: err}
+	}
+	c := Conflict{EntityID: event.EntityID(), Local: local, Remote: remote}
+	c.LocalTime, _ = core.ParseTimestamp(current.Time)
+	c.RemoteTime, _ = core.ParseTimestamp(event.Time())
+	return m.resolver(c)
+}
+
+// next returns the version of an instance at v after reducing event.
+func (v entityVersion) next(event core.Event) entityVersion {
+	next := entityVersion{Clock: v.Clock.Merge(event.Metadata().Version), Time: v.Time}
+	if bytes.Compare(event.Time(), next.Time) > 0 {
+		next.Time = event.Time()
+	}
+	return next
+}
+
+func (m *Model) loadVersion(r ds.Read, baseKey ds.Key, id core.EntityID) (entityVersion, error) {
+	var v entityVersion
+	b, err := r.Get(versionKey(baseKey, id))
+	if err == ds.ErrNotFound {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+func (m *Model) saveVersion(w ds.Write, baseKey ds.Key, id core.EntityID, v entityVersion) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.Put(versionKey(baseKey, id), b)
+}
+
+// versionKey returns the key of the version of the instance id kept under baseKey.
+func versionKey(baseKey ds.Key, id core.EntityID) ds.Key {
+	return versionsPrefix.Child(baseKey).ChildString(id.String())
+}
@@ -0,0 +1,203 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+)
+
+func TestConflicts(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		resolver ConflictResolver
+		edit     func(a, b *Person)
+		expected Person
+	}{
+		{
+			name:     "MergeFields",
+			edit:     func(a, b *Person) { a.Name, b.Age = "A", 50 },
+			expected: Person{Name: "A", Age: 50},
+		},
+		{
+			name:     "LastWriterWins",
+			resolver: LastWriterWins,
+			edit:     func(a, b *Person) { a.Name, b.Name, b.Age = "A", "B", 50 },
+			expected: Person{Name: "B", Age: 50},
+		},
+		{
+			name: "Custom",
+			resolver: func(c Conflict) ([]byte, error) {
+				var local, remote Person
+				if err := json.Unmarshal(c.Local, &local); err != nil {
+					return nil, err
+				}
+				if err := json.Unmarshal(c.Remote, &remote); err != nil {
+					return nil, err
+				}
+				if remote.Age > local.Age {
+					local.Age = remote.Age
+				}
+				return json.Marshal(local)
+			},
+			edit:     func(a, b *Person) { a.Age, b.Age = 60, 50 },
+			expected: Person{Name: "Foo", Age: 60},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			transport := peers{}
+			var opts []ModelOption
+			if tt.resolver != nil {
+				opts = append(opts, WithConflictResolver(tt.resolver))
+			}
+			a, b := createTestStore(WithReplicaID("a")), createTestStore(WithReplicaID("b"))
+			ra, rb := NewReplicator(a, transport), NewReplicator(b, transport)
+			transport["a"] = ra
+			ma, err := a.Register("Person", &Person{}, opts...)
+			checkErr(t, err)
+			mb, err := b.Register("Person", &Person{}, opts...)
+			checkErr(t, err)
+
+			p := &Person{Name: "Foo", Age: 42}
+			checkErr(t, ma.Create(p))
+			checkErr(t, rb.Sync(ctx, "a"))
+
+			// Both replicas change the instance without knowing about the other change
+			pa, pb := *p, *p
+			tt.edit(&pa, &pb)
+			checkErr(t, ma.Save(&pa))
+			checkErr(t, mb.Save(&pb))
+			checkErr(t, rb.Sync(ctx, "a"))
+
+			tt.expected.ID = p.ID
+			for _, m := range []*Model{ma, mb} {
+				var got Person
+				checkErr(t, m.FindByID(p.ID, &got))
+				if !reflect.DeepEqual(got, tt.expected) {
+					t.Fatalf("replicas should converge to %v, got %v", tt.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSequentialChanges(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := peers{}
+	var conflicts int
+	resolver := func(c Conflict) ([]byte, error) {
+		conflicts++
+		return c.Remote, nil
+	}
+	a, b := createTestStore(WithReplicaID("a")), createTestStore(WithReplicaID("b"))
+	rb := NewReplicator(b, transport)
+	transport["a"] = NewReplicator(a, transport)
+	ma, err := a.Register("Person", &Person{}, WithConflictResolver(resolver))
+	checkErr(t, err)
+	mb, err := b.Register("Person", &Person{}, WithConflictResolver(resolver))
+	checkErr(t, err)
+
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, ma.Create(p))
+	checkErr(t, rb.Sync(ctx, "a"))
+	p.Age = 43
+	checkErr(t, mb.Save(p))
+	checkErr(t, rb.Sync(ctx, "a"))
+	p.Age = 44
+	checkErr(t, ma.Save(p))
+	checkErr(t, rb.Sync(ctx, "a"))
+	if conflicts != 0 {
+		t.Fatalf("changes made after seeing each other aren't concurrent, got %d conflicts", conflicts)
+	}
+	assertPersonInModel(t, mb, p)
+}
+
+func TestUnappliableConflict(t *testing.T) {
+	t.Parallel()
+	s := createTestStore(WithReplicaID("b"))
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+
+	// A concurrent create of the same instance can't be applied over it
+	id := p.ID
+	a := core.Action{
+		Type:       core.Create,
+		EntityID:   id,
+		EntityType: m.schema.Ref,
+		Current:    &Person{ID: id, Name: "Bar", Age: 1},
+		Metadata:   core.Metadata{Version: core.VectorClock{"a": 1}},
+	}
+	events, err := jsonpatcher.New().Create([]core.Action{a})
+	checkErr(t, err)
+	if err := m.Reduce(events[0]); err == nil {
+		t.Fatal("unappliable concurrent event should fail to reduce")
+	}
+	assertPersonInModel(t, m, p)
+}
+
+type failingSigner struct {
+	fail bool
+}
+
+func (s *failingSigner) PublicKey() []byte {
+	return nil
+}
+
+func (s *failingSigner) Sign(data []byte) ([]byte, error) {
+	if s.fail {
+		return nil, errFlaky
+	}
+	return data, nil
+}
+
+func TestIssuedVersions(t *testing.T) {
+	t.Parallel()
+	signer := &failingSigner{}
+	s := createTestStore(WithSigner(signer))
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+	assertIssued := func() {
+		t.Helper()
+		m.issuedLock.Lock()
+		defer m.issuedLock.Unlock()
+		if len(m.issued) != 0 {
+			t.Fatalf("issued versions should be released after commit, got %v", m.issued)
+		}
+	}
+
+	// Changes of an instance in a transaction get increasing versions
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+	checkErr(t, m.WriteTxn(func(txn *Txn) error {
+		p.Age = 43
+		if err := txn.Save(p); err != nil {
+			return err
+		}
+		p.Age = 44
+		return txn.Save(p)
+	}))
+	assertIssued()
+	assertPersonInModel(t, m, p)
+
+	// Failed commits release their versions too
+	signer.fail = true
+	p.Age = 45
+	if err := m.Save(p); err != errFlaky {
+		t.Fatalf("expected flaky error, got: %v", err)
+	}
+	assertIssued()
+	signer.fail = false
+	checkErr(t, m.Save(p))
+	assertPersonInModel(t, m, p)
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidTimestamp indicates the bytes aren't an encoded Timestamp
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+)
+
+// Timestamp is a hybrid logical clock reading: the physical time in
+// nanoseconds plus a logical counter ordering readings in the same
+// nanosecond, or taken while the physical clock lags behind.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+// Bytes encodes t in big endian, so encoded timestamps sort lexicographically.
+func (t Timestamp) Bytes() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(t.Wall))
+	binary.BigEndian.PutUint32(b[8:], t.Logical)
+	return b
+}
+
+// Compare returns -1, 0 or 1 if t is before, equal or after o.
+func (t Timestamp) Compare(o Timestamp) int {
+	switch {
+	case t.Wall < o.Wall:
+		return -1
+	case t.Wall > o.Wall:
+		return 1
+	case t.Logical < o.Logical:
+		return -1
+	case t.Logical > o.Logical:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ParseTimestamp decodes the Time of an Event. Times with just the
+// physical part, as encoded by older events, have a zero logical counter.
+func ParseTimestamp(b []byte) (Timestamp, error) {
+	switch len(b) {
+	case 8:
+		return Timestamp{Wall: int64(binary.BigEndian.Uint64(b))}, nil
+	case 12:
+		return Timestamp{
+			Wall:    int64(binary.BigEndian.Uint64(b)),
+			Logical: binary.BigEndian.Uint32(b[8:]),
+		}, nil
+	default:
+		return Timestamp{}, ErrInvalidTimestamp
+	}
+}
+
+// Clock stamps events so that they're ordered consistently with causality
+// across nodes.
+type Clock interface {
+	// Now returns a timestamp after every previous one.
+	Now() Timestamp
+	// Update merges a timestamp received from another node, so that
+	// following readings are after it. It returns the merged reading.
+	Update(remote Timestamp) Timestamp
+}
+
+// HLC is a hybrid logical clock. Its readings follow the physical clock,
+// but never go backwards, and are always after merged remote timestamps
+// even if the local physical clock is behind.
+type HLC struct {
+	lock     sync.Mutex
+	physical func() time.Time
+	last     Timestamp
+}
+
+var _ Clock = (*HLC)(nil)
+
+// NewHLC returns a hybrid logical clock following the system clock.
+func NewHLC() *HLC {
+	return NewHLCWithSource(time.Now)
+}
+
+// NewHLCWithSource returns a hybrid logical clock following physical.
+func NewHLCWithSource(physical func() time.Time) *HLC {
+	return &HLC{physical: physical}
+}
+
+// Now returns a timestamp after every previous one.
+func (c *HLC) Now() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pt := c.physical().UnixNano()
+	if pt > c.last.Wall {
+		c.last = Timestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges a remote timestamp into the clock.
+func (c *HLC) Update(remote Timestamp) Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pt := c.physical().UnixNano()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last = Timestamp{Wall: pt}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(0, 1000)
+	clock := NewHLCWithSource(func() time.Time { return now })
+
+	t1 := clock.Now()
+	t2 := clock.Now()
+	if t2.Compare(t1) <= 0 {
+		t.Fatalf("%v should be after %v with a stuck physical clock", t2, t1)
+	}
+	now = now.Add(-time.Second)
+	if t3 := clock.Now(); t3.Compare(t2) <= 0 {
+		t.Fatalf("%v should be after %v with a physical clock going backwards", t3, t2)
+	}
+
+	remote := Timestamp{Wall: now.Add(time.Hour).UnixNano(), Logical: 5}
+	merged := clock.Update(remote)
+	if merged.Compare(remote) <= 0 {
+		t.Fatalf("merged %v should be after remote %v", merged, remote)
+	}
+	if t4 := clock.Now(); t4.Compare(remote) <= 0 {
+		t.Fatalf("%v should be after remote %v", t4, remote)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if t5 := clock.Now(); t5 != (Timestamp{Wall: now.UnixNano()}) {
+		t.Fatalf("clock should follow the physical clock once it's ahead, got %v", t5)
+	}
+}
+
+func TestTimestampBytes(t *testing.T) {
+	t.Parallel()
+	ts := []Timestamp{{Wall: 1}, {Wall: 1, Logical: 1}, {Wall: 2}}
+	for i := 1; i < len(ts); i++ {
+		if bytes.Compare(ts[i-1].Bytes(), ts[i].Bytes()) >= 0 {
+			t.Fatalf("encoded %v should sort before %v", ts[i-1], ts[i])
+		}
+	}
+	parsed, err := ParseTimestamp(ts[1].Bytes())
+	if err != nil || parsed != ts[1] {
+		t.Fatalf("expected %v, got %v (%v)", ts[1], parsed, err)
+	}
+
+	legacy := NewNullEvent(time.Unix(0, 42)).Time()
+	if parsed, err := ParseTimestamp(legacy); err != nil || parsed != (Timestamp{Wall: 42}) {
+		t.Fatalf("legacy times should be parsed with a zero logical counter, got %v (%v)", parsed, err)
+	}
+	if _, err := ParseTimestamp([]byte{1}); err != ErrInvalidTimestamp {
+		t.Fatalf("expected invalid timestamp error, got: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,6 +14,11 @@ const (
 	EmptyEntityID = EntityID("")
 )
 
+var (
+	// ErrNotRevertible indicates an event which doesn't carry what's needed to revert it
+	ErrNotRevertible = errors.New("event can't be reverted")
+)
+
 type EntityID string
 
 func NewEntityID() EntityID {
@@ -28,6 +34,7 @@ type Event interface {
 	Time() []byte
 	EntityID() EntityID
 	Type() string
+	Metadata() Metadata
 }
 
 func NewNullEvent(t time.Time) Event {
@@ -36,6 +43,7 @@ func NewNullEvent(t time.Time) Event {
 
 type nullEvent struct {
 	Timestamp time.Time
+	Meta      Metadata
 }
 
 func (n *nullEvent) Body() []byte {
@@ -58,6 +66,10 @@ func (n *nullEvent) Type() string {
 	return "null"
 }
 
+func (n *nullEvent) Metadata() Metadata {
+	return n.Meta
+}
+
 // Sanity check
 var _ Event = (*nullEvent)(nil)
 
@@ -81,11 +93,32 @@ type Action struct {
 	Previous interface{}
 	// Current is the instance after the action was done
 	Current interface{}
+	// Metadata is the envelope to be attached to the generated event
+	Metadata Metadata
 }
 
 type EventCodec interface {
-	// Reduce applies generated events into state
-	Reduce(e Event, datastore ds.Datastore, baseKey ds.Key) error
+	// Reduce applies generated events into state within txn, which is
+	// committed by the caller once the event is reduced, so every key
+	// written by a reducer is committed together
+	Reduce(e Event, txn ds.Txn, baseKey ds.Key) error
 	// Create corresponding events to be dispatched
 	Create(ops []Action) ([]Event, error)
 }
+
+// Clocked is implemented by EventCodecs stamping events with a Clock, so
+// the store can share it with the dispatcher.
+type Clocked interface {
+	// Clock returns the clock stamping events.
+	Clock() Clock
+	// SetClock replaces the clock stamping events.
+	SetClock(c Clock)
+}
+
+// Reverter is implemented by EventCodecs whose events can be reverted.
+type Reverter interface {
+	// Revert returns the JSON encoded instance restoring over current, the
+	// JSON encoded instance or nil if it doesn't exist, the changes done
+	// by e. A nil result means the instance doesn't exist before e.
+	Revert(e Event, current []byte) ([]byte, error)
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type metadataKey struct{}
+
+// Metadata is an envelope of information about who and what caused an Event.
+// It's persisted along with the event, so it's available to reducers and
+// when querying the event history.
+type Metadata struct {
+	// EventID uniquely identifies the event across every node, so
+	// duplicated events are detected when they're dispatched again
+	EventID string
+	// ActorID identifies who made the change
+	ActorID string
+	// CorrelationID groups all events originated by the same request
+	CorrelationID string
+	// CausationID identifies the message which directly caused the event
+	CausationID string
+	// Headers are arbitrary key-values defined by the user
+	Headers map[string]string
+	// Version is the vector clock of the entity after the event
+	Version VectorClock
+	// Origin is the replica ID of the store which created the event
+	Origin string
+}
+
+// NewEventID returns a new random EventID.
+func NewEventID() string {
+	return uuid.New().String()
+}
+
+// ContextWithMetadata returns a copy of ctx carrying md. Write transactions
+// created with this context attach md to every generated event.
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the Metadata carried by ctx, if any.
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	return md, ok
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var (
+	// ErrUnsignedEvent indicates the event doesn't carry a signature
+	ErrUnsignedEvent = errors.New("event isn't signed")
+	// ErrInvalidSignature indicates the event signature doesn't match its content
+	ErrInvalidSignature = errors.New("invalid event signature")
+)
+
+// Signer signs events created by the local peer.
+type Signer interface {
+	// PublicKey returns the key used to verify signatures made by the Signer
+	PublicKey() []byte
+	// Sign returns the signature of data
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier checks signatures of events created by other peers.
+type Verifier interface {
+	// Verify returns an error if sig isn't a valid signature of data by pubKey
+	Verify(pubKey []byte, data []byte, sig []byte) error
+}
+
+// OriginVerifier is a Verifier which also checks which keys can sign the
+// events created by each replica.
+type OriginVerifier interface {
+	Verifier
+	// VerifyOrigin returns an error if pubKey can't sign events of the replica origin
+	VerifyOrigin(origin string, pubKey []byte) error
+}
+
+// SignedEvent is an Event which carries the signature of its creator.
+type SignedEvent interface {
+	Event
+	PublicKey() []byte
+	Signature() []byte
+}
+
+// SignEvent returns a copy of e signed by s.
+func SignEvent(e Event, s Signer) (SignedEvent, error) {
+	data, err := SigningBytes(e)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	return &signedEvent{
+		Timestamp: e.Time(),
+		ID:        e.EntityID(),
+		TypeName:  e.Type(),
+		Payload:   e.Body(),
+		Meta:      e.Metadata(),
+		Key:       s.PublicKey(),
+		Sig:       sig,
+	}, nil
+}
+
+// VerifyEvent checks e is signed and its signature is valid for v. If v
+// is an OriginVerifier, the key must also be allowed to sign events of
+// the replica in the event metadata Origin.
+func VerifyEvent(e Event, v Verifier) error {
+	se, ok := e.(SignedEvent)
+	if !ok || len(se.Signature()) == 0 {
+		return ErrUnsignedEvent
+	}
+	data, err := SigningBytes(e)
+	if err != nil {
+		return err
+	}
+	if err := v.Verify(se.PublicKey(), data, se.Signature()); err != nil {
+		return err
+	}
+	if ov, ok := v.(OriginVerifier); ok {
+		return ov.VerifyOrigin(e.Metadata().Origin, se.PublicKey())
+	}
+	return nil
+}
+
+// SigningBytes returns the deterministic representation of e which is signed.
+// It covers every part of the event except the signature itself.
+func SigningBytes(e Event) ([]byte, error) {
+	// Encodings of the event log decode empty maps as nil, so they're
+	// signed as nil to be verified once persisted
+	md := e.Metadata()
+	if len(md.Headers) == 0 {
+		md.Headers = nil
+	}
+	if len(md.Version) == 0 {
+		md.Version = nil
+	}
+	return json.Marshal(struct {
+		Time     []byte
+		EntityID EntityID
+		Type     string
+		Body     []byte
+		Metadata Metadata
+	}{
+		Time:     e.Time(),
+		EntityID: e.EntityID(),
+		Type:     e.Type(),
+		Body:     e.Body(),
+		Metadata: md,
+	})
+}
+
+type signedEvent struct {
+	Timestamp []byte
+	ID        EntityID
+	TypeName  string
+	Payload   []byte
+	Meta      Metadata
+	Key       []byte
+	Sig       []byte
+}
+
+func (se *signedEvent) Body() []byte {
+	return se.Payload
+}
+
+func (se *signedEvent) Time() []byte {
+	return se.Timestamp
+}
+
+func (se *signedEvent) EntityID() EntityID {
+	return se.ID
+}
+
+func (se *signedEvent) Type() string {
+	return se.TypeName
+}
+
+func (se *signedEvent) Metadata() Metadata {
+	return se.Meta
+}
+
+func (se *signedEvent) PublicKey() []byte {
+	return se.Key
+}
+
+func (se *signedEvent) Signature() []byte {
+	return se.Sig
+}
+
+var _ SignedEvent = (*signedEvent)(nil)
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownVersion indicates an event body of a version which can't be
+	// upcasted into the current one
+	ErrUnknownVersion = errors.New("unknown event version")
+)
+
+// Upcaster transforms an event body of a version into the next version.
+type Upcaster func(body []byte) ([]byte, error)
+
+// Upcasters is a registry of upcasters, which transform event bodies of
+// older versions into the current one, so events persisted before a
+// format change can still be decoded and replayed. Versions start at 1.
+type Upcasters struct {
+	current int
+	steps   map[int]Upcaster
+}
+
+// NewUpcasters returns an empty registry for bodies of version current.
+func NewUpcasters(current int) *Upcasters {
+	return &Upcasters{current: current, steps: make(map[int]Upcaster)}
+}
+
+// Register sets the upcaster from version from into from+1. If from is the
+// current version, the current version becomes from+1.
+func (u *Upcasters) Register(from int, f Upcaster) {
+	u.steps[from] = f
+	if from+1 > u.current {
+		u.current = from + 1
+	}
+}
+
+// Current returns the version of the bodies returned by Upcast.
+func (u *Upcasters) Current() int {
+	return u.current
+}
+
+// Upcast returns body, of the given version, transformed into the current
+// version by applying in order the upcasters of every version in between.
+func (u *Upcasters) Upcast(version int, body []byte) ([]byte, error) {
+	if version > u.current {
+		return nil, fmt.Errorf("%w: %d is newer than %d", ErrUnknownVersion, version, u.current)
+	}
+	for v := version; v < u.current; v++ {
+		f, ok := u.steps[v]
+		if !ok {
+			return nil, fmt.Errorf("%w: no upcaster from version %d", ErrUnknownVersion, v)
+		}
+		var err error
+		if body, err = f(body); err != nil {
+			return nil, fmt.Errorf("error when upcasting from version %d: %v", v, err)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpcasters(t *testing.T) {
+	t.Parallel()
+	u := NewUpcasters(1)
+	u.Register(1, func(b []byte) ([]byte, error) {
+		return append(b, '2'), nil
+	})
+	u.Register(2, func(b []byte) ([]byte, error) {
+		return append(b, '3'), nil
+	})
+	if u.Current() != 3 {
+		t.Fatalf("expected current version 3, got %d", u.Current())
+	}
+	tests := []struct {
+		version  int
+		expected string
+	}{
+		{1, "v23"},
+		{2, "v3"},
+		{3, "v"},
+	}
+	for _, tt := range tests {
+		b, err := u.Upcast(tt.version, []byte("v"))
+		if err != nil {
+			t.Fatalf("upcasting version %d failed: %v", tt.version, err)
+		}
+		if string(b) != tt.expected {
+			t.Errorf("version %d should be upcasted to %q, got %q", tt.version, tt.expected, b)
+		}
+	}
+	if _, err := u.Upcast(4, nil); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected unknown version error, got: %v", err)
+	}
+
+	missing := NewUpcasters(1)
+	missing.Register(2, func(b []byte) ([]byte, error) { return b, nil })
+	if _, err := missing.Upcast(1, nil); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected unknown version error, got: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+// Causality is how two vector clocks are causally related.
+type Causality int
+
+const (
+	// Equal clocks saw the same changes
+	Equal Causality = iota
+	// Before means the clock saw a subset of the changes of the other one
+	Before
+	// After means the clock saw a superset of the changes of the other one
+	After
+	// Concurrent clocks saw changes the other one didn't
+	Concurrent
+)
+
+func (c Causality) String() string {
+	switch c {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	default:
+		return "unknown"
+	}
+}
+
+// VectorClock counts the changes made by each replica to an entity.
+// Events carry the clock of their entity after the change they make,
+// so concurrent changes from different replicas can be detected.
+type VectorClock map[string]uint64
+
+// Increment returns a copy of v counting one more change by replica.
+func (v VectorClock) Increment(replica string) VectorClock {
+	c := v.Merge(nil)
+	c[replica]++
+	return c
+}
+
+// Merge returns a clock which saw the changes of both v and o.
+func (v VectorClock) Merge(o VectorClock) VectorClock {
+	c := make(VectorClock, len(v))
+	for r, n := range v {
+		c[r] = n
+	}
+	for r, n := range o {
+		if n > c[r] {
+			c[r] = n
+		}
+	}
+	return c
+}
+
+// Compare returns how v is causally related to o.
+func (v VectorClock) Compare(o VectorClock) Causality {
+	var before, after bool
+	for r, n := range v {
+		if n > o[r] {
+			after = true
+		} else if n < o[r] {
+			before = true
+		}
+	}
+	for r, n := range o {
+		if _, ok := v[r]; !ok && n > 0 {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return Before
+	case after:
+		return After
+	default:
+		return Equal
+	}
+}
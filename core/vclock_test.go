@@ -0,0 +1,30 @@
+package core
+
+import "testing"
+
+func TestVectorClock(t *testing.T) {
+	t.Parallel()
+	a := VectorClock{}.Increment("a")
+	ab := a.Increment("b")
+	aa := a.Increment("a")
+	tests := []struct {
+		v, o     VectorClock
+		expected Causality
+	}{
+		{nil, nil, Equal},
+		{nil, a, Before},
+		{a, a.Merge(nil), Equal},
+		{a, ab, Before},
+		{ab, a, After},
+		{ab, aa, Concurrent},
+		{ab.Merge(aa), aa, After},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Compare(tt.o); got != tt.expected {
+			t.Errorf("%v compared to %v should be %s, got %s", tt.v, tt.o, tt.expected, got)
+		}
+	}
+	if a["a"] != 1 || len(a) != 1 {
+		t.Fatalf("increment shouldn't modify the clock, got %v", a)
+	}
+}
@@ -0,0 +1,310 @@
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	deadLettersPrefix = datastore.NewKey("/deadletters")
+
+	// defaultRetryBackoff is the wait before retrying without a RetryPolicy,
+	// doubled on every retry up to defaultMaxRetryBackoff
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 10 * time.Second
+
+	// conflictRetryPolicy is how reductions conflicting with concurrent
+	// ones are retried, before failing with ErrTxnConflict
+	conflictRetryPolicy = RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: defaultRetryBackoff}
+
+	// ErrUnknownReducer indicates there's no registered reducer with the given name
+	ErrUnknownReducer = errors.New("unknown reducer")
+	// ErrDeadLetterNotFound indicates there's no dead letter for the reducer and sequence
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// RetryPolicy defines how failed reductions are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an event is reduced
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled on every retry
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries, if not zero
+	MaxBackoff time.Duration
+}
+
+// DeadLetter is an event which a reducer failed to reduce after
+// all the attempts allowed by its RetryPolicy.
+type DeadLetter struct {
+	// Reducer is the name of the failing reducer
+	Reducer string
+	// Seq is the sequence of the event in the log
+	Seq uint64
+	// Error is the last error returned by the reducer
+	Error string
+	// Attempts is the number of times the event was reduced
+	Attempts int
+	// Time is when the last attempt failed
+	Time time.Time
+}
+
+// DeadLetters returns the dead letters of reducer, or of every reducer if empty.
+func (d *Dispatcher) DeadLetters(reducer string) ([]DeadLetter, error) {
+	prefix := deadLettersPrefix.String() + "/"
+	if reducer != "" {
+		prefix = deadLettersPrefix.ChildString(reducer).String() + "/"
+	}
+	res, err := d.store.Query(query.Query{
+		Prefix: prefix,
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, len(entries))
+	for i := range entries {
+		if letters[i], err = decodeDeadLetter(entries[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// RetryDeadLetter reduces again the event of a dead letter with its reducer.
+// The dead letter is removed if it succeeds, or updated otherwise.
+func (d *Dispatcher) RetryDeadLetter(reducer string, seq uint64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key := deadLetterKey(reducer, seq)
+	b, err := d.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return err
+	}
+	dl, err := decodeDeadLetter(b)
+	if err != nil {
+		return err
+	}
+	var reg *registration
+	for _, r := range d.reducers {
+		if r.name == reducer {
+			reg = r
+			break
+		}
+	}
+	if reg == nil {
+		return ErrUnknownReducer
+	}
+	entries, err := d.events(context.Background(), seq, seq, nil)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 {
+		return fmt.Errorf("event %d not found in log", seq)
+	}
+
+	if rerr := reg.reducer.Reduce(entries[0].Event); rerr != nil {
+		dl.Attempts++
+		dl.Error = rerr.Error()
+		dl.Time = time.Now()
+		if err := d.putDeadLetter(dl); err != nil {
+			return err
+		}
+		return rerr
+	}
+	return d.store.Delete(key)
+}
+
+// DiscardDeadLetter removes a dead letter without reducing its event.
+func (d *Dispatcher) DiscardDeadLetter(reducer string, seq uint64) error {
+	key := deadLetterKey(reducer, seq)
+	exists, err := d.store.Has(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrDeadLetterNotFound
+	}
+	return d.store.Delete(key)
+}
+
+// reduceWithRetry reduces event with r following its retry policy. If the
+// first attempt fails, the event is retried in the background, so the locks
+// held while dispatching aren't held while waiting to retry, and so are the
+// events after it until it's reduced or stored as a dead letter, so r still
+// reduces events in order.
+func (d *Dispatcher) reduceWithRetry(r *registration, seq uint64, event core.Event) error {
+	r.lock.Lock()
+	if len(r.backlog) > 0 {
+		r.backlog = append(r.backlog, reduceJob{seq: seq, event: event})
+		r.lock.Unlock()
+		return nil
+	}
+	r.lock.Unlock()
+
+	f := func() error { return r.reducer.Reduce(event) }
+	err := f()
+	if err != nil && r.policy.MaxAttempts <= 1 {
+		err = d.retryFailed(d.ctx, r.name, seq, r.policy, err, f)
+	}
+	if err == nil {
+		return nil
+	}
+	r.lock.Lock()
+	r.backlog = append(r.backlog, reduceJob{seq: seq, event: event})
+	r.lock.Unlock()
+	d.retries.Add(1)
+	go d.retryBacklog(r, err)
+	return nil
+}
+
+// retryBacklog reduces the events in the backlog of r, starting by its first
+// one, which failed with err. It stops when the backlog is empty, or when the
+// dispatcher is closed, leaving the remaining events to be caught up when r
+// is registered again.
+func (d *Dispatcher) retryBacklog(r *registration, err error) {
+	defer d.retries.Done()
+	for {
+		r.lock.Lock()
+		j := r.backlog[0]
+		r.lock.Unlock()
+		f := func() error { return r.reducer.Reduce(j.event) }
+		if err != nil {
+			err = d.retryFailed(d.ctx, r.name, j.seq, r.policy, err, f)
+		} else {
+			err = d.retry(d.ctx, r.name, j.seq, r.policy, f)
+		}
+		if err != nil {
+			log.Errorf("error when retrying reducer %s at %d: %v", r.name, j.seq, err)
+			r.lock.Lock()
+			r.backlog = nil
+			r.lock.Unlock()
+			r.fail(j.seq)
+			d.notify()
+			return
+		}
+
+		r.lock.Lock()
+		r.backlog = r.backlog[1:]
+		empty := len(r.backlog) == 0
+		r.lock.Unlock()
+		reduced := j.seq
+		if d.async != nil {
+			reduced = d.async.watermark()
+		}
+		if err := d.saveCheckpoint(r, reduced); err != nil {
+			log.Errorf("error when saving checkpoint of reducer %s: %v", r.name, err)
+		}
+		d.notify()
+		if empty {
+			return
+		}
+	}
+}
+
+// retrying returns true if an event up to seq is waiting to be retried.
+func (d *Dispatcher) retrying(seq uint64) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for _, r := range d.reducers {
+		r.lock.Lock()
+		pending := len(r.backlog) > 0 && r.backlog[0].seq <= seq
+		r.lock.Unlock()
+		if pending {
+			return true
+		}
+	}
+	return false
+}
+
+// waitRetries blocks until no event up to seq is waiting to be retried,
+// or ctx is done.
+func (d *Dispatcher) waitRetries(ctx context.Context, seq uint64) error {
+	c, stop := d.watch()
+	defer stop()
+	for d.retrying(seq) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c:
+		}
+	}
+	return nil
+}
+
+// retry invokes f for the event seq until it succeeds or ctx is done. With a
+// policy, it gives up after all its attempts and stores a dead letter for name.
+func (d *Dispatcher) retry(ctx context.Context, name string, seq uint64, policy *RetryPolicy, f func() error) error {
+	err := f()
+	if err == nil {
+		return nil
+	}
+	return d.retryFailed(ctx, name, seq, policy, err, f)
+}
+
+// retryFailed is retry after a first attempt which failed with err.
+func (d *Dispatcher) retryFailed(ctx context.Context, name string, seq uint64, policy *RetryPolicy, err error, f func() error) error {
+	backoff, maxBackoff := defaultRetryBackoff, defaultMaxRetryBackoff
+	if policy != nil {
+		backoff, maxBackoff = policy.Backoff, policy.MaxBackoff
+	}
+	attempts := 1
+	for {
+		if policy != nil && attempts >= policy.MaxAttempts {
+			log.Errorf("%s failed to handle event %d after %d attempts: %v", name, seq, attempts, err)
+			return d.putDeadLetter(DeadLetter{
+				Reducer:  name,
+				Seq:      seq,
+				Error:    err.Error(),
+				Attempts: attempts,
+				Time:     time.Now(),
+			})
+		}
+		log.Warningf("%s failed to handle event %d, retrying: %v", name, seq, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if maxBackoff != 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		attempts++
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+}
+
+func (d *Dispatcher) putDeadLetter(dl DeadLetter) error {
+	b := bytes.Buffer{}
+	if err := gob.NewEncoder(&b).Encode(dl); err != nil {
+		return err
+	}
+	return d.store.Put(deadLetterKey(dl.Reducer, dl.Seq), b.Bytes())
+}
+
+func decodeDeadLetter(b []byte) (DeadLetter, error) {
+	var dl DeadLetter
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&dl)
+	return dl, err
+}
+
+func deadLetterKey(reducer string, seq uint64) datastore.Key {
+	return deadLettersPrefix.ChildString(reducer).ChildString(fmt.Sprintf("%020d", seq))
+}
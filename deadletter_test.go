@@ -0,0 +1,192 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	reducer := &flakyReducer{failures: 2}
+	dispatcher.Register(reducer, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(time.Now())))
+	checkErr(t, dispatcher.WaitFor(context.Background(), 1))
+	if reducer.calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", reducer.calls)
+	}
+	letters, err := dispatcher.DeadLetters("")
+	checkErr(t, err)
+	if len(letters) != 0 {
+		t.Fatal("there shouldn't be dead letters")
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	reducer := &flakyReducer{failures: 100}
+	dispatcher.Register(reducer, WithReducerName("flaky"), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	dispatcher.Register(&nullReducer{}, WithReducerName("null"), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))); err != nil {
+			t.Fatalf("dead lettered events shouldn't fail dispatch: %v", err)
+		}
+	}
+	checkErr(t, dispatcher.WaitFor(context.Background(), 3))
+
+	letters, err := dispatcher.DeadLetters("flaky")
+	checkErr(t, err)
+	if len(letters) != 3 {
+		t.Fatalf("expected 3 dead letters, got %d", len(letters))
+	}
+	for i, dl := range letters {
+		if dl.Reducer != "flaky" || dl.Seq != uint64(i+1) || dl.Attempts != 2 || dl.Error != errFlaky.Error() {
+			t.Fatalf("unexpected dead letter: %+v", dl)
+		}
+	}
+	if letters, err := dispatcher.DeadLetters("null"); err != nil || len(letters) != 0 {
+		t.Fatal("null reducer shouldn't have dead letters")
+	}
+
+	t.Run("RetryFailing", func(t *testing.T) {
+		if err := dispatcher.RetryDeadLetter("flaky", 1); !errors.Is(err, errFlaky) {
+			t.Fatalf("expected reducer error, got: %v", err)
+		}
+		letters, err := dispatcher.DeadLetters("flaky")
+		checkErr(t, err)
+		if len(letters) != 3 || letters[0].Attempts != 3 {
+			t.Fatal("failed retry should update the dead letter")
+		}
+	})
+	t.Run("Retry", func(t *testing.T) {
+		reducer.setFailures(0)
+		checkErr(t, dispatcher.RetryDeadLetter("flaky", 1))
+		letters, err := dispatcher.DeadLetters("flaky")
+		checkErr(t, err)
+		if len(letters) != 2 || letters[0].Seq != 2 {
+			t.Fatal("successful retry should remove the dead letter")
+		}
+	})
+	t.Run("Discard", func(t *testing.T) {
+		checkErr(t, dispatcher.DiscardDeadLetter("flaky", 2))
+		if err := dispatcher.DiscardDeadLetter("flaky", 2); err != ErrDeadLetterNotFound {
+			t.Fatalf("expected not found error, got: %v", err)
+		}
+		letters, err := dispatcher.DeadLetters("flaky")
+		checkErr(t, err)
+		if len(letters) != 1 || letters[0].Seq != 3 {
+			t.Fatal("discarded dead letter should be removed")
+		}
+	})
+	t.Run("UnknownReducer", func(t *testing.T) {
+		if err := dispatcher.RetryDeadLetter("unknown", 3); err != ErrDeadLetterNotFound {
+			t.Fatalf("expected not found error, got: %v", err)
+		}
+	})
+}
+
+func TestRetryInBackground(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	reducer := &flakyReducer{failures: 100}
+	other := &orderReducer{}
+	dispatcher.Register(reducer, WithReducerName("flaky"), WithRetryPolicy(RetryPolicy{MaxAttempts: 100, Backoff: time.Hour}))
+	dispatcher.Register(other, WithReducerName("other"))
+
+	// Retries don't block dispatching, while events after a failed one
+	// wait for it to be reduced
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))))
+	}
+	if reducer.calls != 1 || len(other.events) != 3 {
+		t.Fatalf("expected 1 and 3 calls, got %d and %d", reducer.calls, len(other.events))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dispatcher.WaitFor(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded error waiting for retried event, got: %v", err)
+	}
+
+	// Closing stops retrying, leaving the events to be caught up later
+	checkErr(t, dispatcher.Close())
+	if reducer.calls != 1 {
+		t.Fatalf("closed dispatcher shouldn't retry, got %d calls", reducer.calls)
+	}
+	if cp, err := dispatcher.Checkpoint("flaky"); err != nil || cp != 0 {
+		t.Fatalf("checkpoint shouldn't advance past retried events, got %d: %v", cp, err)
+	}
+	if cp, err := dispatcher.Checkpoint("other"); err != nil || cp != 3 {
+		t.Fatalf("expected checkpoint 3, got %d: %v", cp, err)
+	}
+	reloaded := NewDispatcher(dispatcher.Store())
+	reducer.setFailures(0)
+	checkErr(t, reloaded.Register(reducer, WithReducerName("flaky"), WithRetryPolicy(RetryPolicy{MaxAttempts: 100})))
+	if reducer.calls != 4 {
+		t.Fatalf("expected retried events to be caught up, got %d calls", reducer.calls)
+	}
+}
+
+var errFlaky = errors.New("flaky error")
+
+type flakyReducer struct {
+	lock     sync.Mutex
+	failures int
+	calls    int
+}
+
+func (r *flakyReducer) setFailures(n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = n
+}
+
+func (r *flakyReducer) Reduce(e core.Event) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls++
+	if r.failures > 0 {
+		r.failures--
+		return errFlaky
+	}
+	return nil
+}
+
+func TestModelRetryPolicy(t *testing.T) {
+	t.Parallel()
+	s := createTestStore()
+	failures := 1
+	m, err := s.Register("Book", &loanedBook{},
+		WithEvent("BookBorrowed", &bookBorrowed{}, func(instance, event interface{}) error {
+			if failures > 0 {
+				failures--
+				return errFlaky
+			}
+			instance.(*loanedBook).Loans++
+			return nil
+		}),
+		WithModelRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}),
+	)
+	checkErr(t, err)
+
+	// The failed event is retried, and write transactions wait for it
+	b := &loanedBook{Title: "Title1"}
+	checkErr(t, m.Create(b))
+	checkErr(t, m.WriteTxn(func(txn *Txn) error {
+		return txn.Emit(b.ID, bookBorrowed{UserID: "alice"})
+	}))
+	checkErr(t, m.WriteTxn(func(txn *Txn) error {
+		return txn.Emit(b.ID, bookBorrowed{UserID: "bob"})
+	}))
+	assertLoanedBook(t, m, b.ID, "", 2)
+	if letters, err := s.dispatcher.DeadLetters("Book"); err != nil || len(letters) != 0 {
+		t.Fatalf("retried event shouldn't be dead lettered, got %v: %v", letters, err)
+	}
+}
@@ -1,13 +1,13 @@
 package eventstore
 
 import (
-	"bytes"
-	"encoding/gob"
-	"sync"
-
 	"context"
+	"fmt"
+	"sync"
 
+	cid "github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipfs/go-datastore/query"
 	"github.com/textileio/go-eventstore/core"
 	"golang.org/x/sync/errgroup"
@@ -22,18 +22,66 @@ type Reducer interface {
 // This is different from generic pub-sub systems because reducers are not subscribed to particular events.
 // Every event is dispatched to every registered reducer. When a given reducer is registered, it returns a `token`,
 // which can be used to deregister the reducer later.
+//
+// Persisted events form a hash-linked log: each record is identified by a CID
+// and includes the CID of the previous one, so truncation or modification
+// of history can be detected with Verify.
 type Dispatcher struct {
 	store    datastore.TxnDatastore
-	reducers []Reducer
+	reducers []*registration
 	lock     sync.RWMutex
 	lastID   int
+
+	encoding Encoding
+	clock    core.Clock
+	async    *asyncReducer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	retries  sync.WaitGroup
+	cplock   sync.Mutex
+	loaded   bool
+	seq      uint64
+	head     []byte
+	migrated uint64
+
+	wlock    sync.Mutex
+	watchers map[chan struct{}]struct{}
+}
+
+// DispatcherOption configures optional behavior of a Dispatcher.
+type DispatcherOption func(*Dispatcher)
+
+// WithEncoding sets the encoding of newly persisted events. Events already
+// persisted with other encodings are still readable.
+func WithEncoding(enc Encoding) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.encoding = enc
+	}
+}
+
+// WithClock makes the dispatcher merge the time of every dispatched event into
+// c, so events created afterwards with c are ordered after them, even if they
+// come from nodes with clocks ahead of the local one. NewStore shares c with
+// the codec and the store.
+func WithClock(c core.Clock) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.clock = c
+	}
 }
 
 // NewDispatcher creates a new EventDispatcher
-func NewDispatcher(store datastore.TxnDatastore) *Dispatcher {
-	return &Dispatcher{
-		store: store,
+func NewDispatcher(store datastore.TxnDatastore, opts ...DispatcherOption) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		store:    store,
+		encoding: GobEncoding,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
+	return d
 }
 
 // Store returns the internal event store.
@@ -41,49 +89,339 @@ func (d *Dispatcher) Store() datastore.TxnDatastore {
 	return d.store
 }
 
-// Register takes a reducer to be invoked with each dispatched event
-func (d *Dispatcher) Register(reducer Reducer) {
+// registration is a reducer registered in the dispatcher.
+type registration struct {
+	name    string
+	reducer Reducer
+	policy  *RetryPolicy
+	// legacy is true if the reducer reduced the events of legacy logs
+	// before they were migrated
+	legacy bool
+
+	lock       sync.Mutex
+	checkpoint uint64
+	// backlog holds the events waiting for a failed reduction to be retried
+	backlog []reduceJob
+	// failed is the first event the reducer failed to reduce, if any
+	failed uint64
+	// pending holds the events enqueued for asynchronous reduction which
+	// the reducer didn't reduce yet
+	pending map[uint64]struct{}
+}
+
+// ReducerOption configures how a registered reducer is invoked.
+type ReducerOption func(*registration)
+
+// WithReducerName identifies the reducer, e.g. in dead letters. By default,
+// reducers are named after their registration order.
+func WithReducerName(name string) ReducerOption {
+	return func(r *registration) {
+		r.name = name
+	}
+}
+
+// WithRetryPolicy makes the dispatcher retry failed reductions following p.
+// Events still failing after all the attempts are stored as dead letters.
+// Failed events are retried in the background, and the following ones are
+// reduced once they're done, so dispatching doesn't wait for retries. Use
+// WaitFor to wait for them.
+func WithRetryPolicy(p RetryPolicy) ReducerOption {
+	return func(r *registration) {
+		r.policy = &p
+	}
+}
+
+// withLegacyReduced marks the reducer as having reduced the events of
+// legacy logs, so they aren't reduced again once migrated.
+func withLegacyReduced() ReducerOption {
+	return func(r *registration) {
+		r.legacy = true
+	}
+}
+
+// Register takes a reducer to be invoked with each dispatched event.
+// Reducers are checkpointed with the last event they reduced, so if the
+// log has events the reducer (identified by its name) didn't reduce yet,
+// they're reduced before Register returns.
+func (d *Dispatcher) Register(reducer Reducer, opts ...ReducerOption) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.lastID++
-	d.reducers = append(d.reducers, reducer)
+	r := &registration{
+		name:    fmt.Sprintf("reducer-%d", d.lastID),
+		reducer: reducer,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	d.reducers = append(d.reducers, r)
+	return d.catchUp(r)
+}
+
+// DispatchStatus reports what the dispatcher did with an event.
+type DispatchStatus int
+
+const (
+	// Rejected means the event wasn't persisted, e.g. because it was invalid
+	// or the dispatch failed. It's returned along with an error.
+	Rejected DispatchStatus = iota
+	// Dispatched means the event was persisted and reduced. Along with an
+	// error, it was persisted but some reducer failed to reduce it, and
+	// it's reduced again once the reducer is registered again.
+	Dispatched
+	// Duplicate means the event was already persisted, so it was skipped
+	Duplicate
+	// Quarantined means the event was invalid for its model, so the store
+	// kept it aside instead of dispatching it
+	Quarantined
+)
+
+func (s DispatchStatus) String() string {
+	switch s {
+	case Rejected:
+		return "rejected"
+	case Dispatched:
+		return "dispatched"
+	case Duplicate:
+		return "duplicate"
+	case Quarantined:
+		return "quarantined"
+	default:
+		return fmt.Sprintf("DispatchStatus(%d)", int(s))
+	}
 }
 
 // Dispatch dispatches a payload to all registered reducers.
 func (d *Dispatcher) Dispatch(event core.Event) error {
+	return d.DispatchBatch([]core.Event{event})
+}
+
+// DispatchBatch persists events in a single write, and then dispatches
+// them in order to all registered reducers. If the dispatcher reduces
+// asynchronously, it returns as soon as events are persisted and queued.
+// Events already persisted, with the same key or EventID, are skipped.
+func (d *Dispatcher) DispatchBatch(events []core.Event) error {
+	_, err := d.dispatchBatch(events)
+	return err
+}
+
+func (d *Dispatcher) dispatchBatch(events []core.Event) ([]DispatchStatus, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seqs, statuses, err := d.append(events)
+	if err != nil {
+		return nil, err
+	}
+	if d.clock != nil {
+		for i := range events {
+			if statuses[i] != Dispatched {
+				continue
+			}
+			// Events with times not encoded as timestamps can't be merged
+			if ts, err := core.ParseTimestamp(events[i].Time()); err == nil {
+				d.clock.Update(ts)
+			}
+		}
+	}
+	if d.async != nil {
+		var jobs []reduceJob
+		for i := range events {
+			if statuses[i] == Dispatched {
+				jobs = append(jobs, reduceJob{seq: seqs[i], event: events[i], reducers: d.reducers})
+			}
+		}
+		err := d.async.enqueue(jobs)
+		d.async.observe(d.seq)
+		d.notify()
+		return statuses, err
+	}
+	// Safe to fire off reducers now that events are persisted
+	defer d.notify()
+	regs := d.reducers
+	for i, event := range events {
+		if statuses[i] == Duplicate {
+			continue
+		}
+		if rerr := d.reduce(regs, seqs[i], event); rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			// Reducers which failed skip the rest of the batch, so they
+			// reduce events in order, and the others keep reducing it
+			regs = notFailedAt(regs, seqs[i])
+		}
+	}
+	// Reducers are checkpointed once per batch, and the failed ones
+	// only up to the event they failed to reduce
+	if cerr := d.saveCheckpoints(d.reducers, d.seq); cerr != nil && err == nil {
+		err = cerr
+	}
+	return statuses, err
+}
+
+// notFailedAt returns the reducers in regs which didn't fail to reduce
+// the event seq.
+func notFailedAt(regs []*registration, seq uint64) []*registration {
+	var res []*registration
+	for _, r := range regs {
+		r.lock.Lock()
+		failed := r.failed == seq
+		r.lock.Unlock()
+		if !failed {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// watch returns a channel signaled when events are dispatched, and
+// a function to stop watching.
+func (d *Dispatcher) watch() (<-chan struct{}, func()) {
+	d.wlock.Lock()
+	defer d.wlock.Unlock()
+	if d.watchers == nil {
+		d.watchers = make(map[chan struct{}]struct{})
+	}
+	c := make(chan struct{}, 1)
+	d.watchers[c] = struct{}{}
+	return c, func() {
+		d.wlock.Lock()
+		defer d.wlock.Unlock()
+		delete(d.watchers, c)
+	}
+}
+
+func (d *Dispatcher) notify() {
+	d.wlock.Lock()
+	defer d.wlock.Unlock()
+	for c := range d.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LastSeq returns the sequence of the last persisted event.
+func (d *Dispatcher) LastSeq() (uint64, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	// Key format: <timestamp>/<entity-id>/<type>
-	// @todo: This is up for debate, its a 'fake' Event struct right now anyway
-	key := datastore.NewKey(string(event.Time())).ChildString(event.EntityID().String()).ChildString(event.Type())
-	// Encode and add an Event to event store
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	if err := e.Encode(event); err != nil {
-		return err
-	}
-	if err := d.Store().Put(key, b.Bytes()); err != nil {
-		return err
-	}
-	// Safe to fire off reducers now that event is persisted
+	if err := d.loadHead(); err != nil {
+		return 0, err
+	}
+	return d.seq, nil
+}
+
+// waitReducers blocks until every event up to seq was reduced by the
+// registered reducers in rs, including failed reductions being retried,
+// or ctx is done. Other reducers aren't waited for.
+func (d *Dispatcher) waitReducers(ctx context.Context, seq uint64, rs ...Reducer) error {
+	c, stop := d.watch()
+	defer stop()
+	for d.reducing(seq, rs) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c:
+		}
+	}
+	return nil
+}
+
+// reducing returns true if a registered reducer in rs didn't reduce an
+// event up to seq yet.
+func (d *Dispatcher) reducing(seq uint64, rs []Reducer) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for _, r := range d.reducers {
+		for _, reducer := range rs {
+			if r.reducer != reducer {
+				continue
+			}
+			r.lock.Lock()
+			busy := r.busy(seq)
+			r.lock.Unlock()
+			if busy {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WaitFor blocks until every event up to seq was reduced, or ctx is done.
+// It only blocks if the dispatcher reduces asynchronously, or if failed
+// reductions of events up to seq are being retried.
+func (d *Dispatcher) WaitFor(ctx context.Context, seq uint64) error {
+	if d.async != nil {
+		last, err := d.LastSeq()
+		if err != nil {
+			return err
+		}
+		d.async.observe(last)
+		if err := d.async.waitFor(ctx, seq); err != nil {
+			return err
+		}
+	}
+	return d.waitRetries(ctx, seq)
+}
+
+// Close stops the dispatcher. If it reduces asynchronously, it waits
+// for queued events to be reduced. Failed reductions aren't retried
+// anymore, so they're reduced again once their reducer is registered.
+func (d *Dispatcher) Close() error {
+	d.cancel()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.async != nil {
+		d.async.close()
+	}
+	d.retries.Wait()
+	return nil
+}
+
+// reduce invokes every registered reducer with event, which is persisted with seq.
+func (d *Dispatcher) reduce(regs []*registration, seq uint64, event core.Event) error {
+	if d.async != nil {
+		defer d.notify()
+	}
 	g, _ := errgroup.WithContext(context.Background())
-	for _, reducer := range d.reducers {
+	for _, r := range regs {
+		r := r
 		// Launch each reducer in a separate goroutine
 		g.Go(func() error {
-			return reducer.Reduce(event)
+			defer r.reduced(seq)
+			if r.policy != nil {
+				return d.reduceWithRetry(r, seq, event)
+			}
+			if err := r.reducer.Reduce(event); err != nil {
+				r.fail(seq)
+				return err
+			}
+			return nil
 		})
 	}
 	// Wait for all reducers to complete or error out
-	if err := g.Wait(); err != nil {
-		return err
+	return g.Wait()
+}
+
+// Head returns the CID of the last persisted event, or cid.Undef if the log is empty.
+func (d *Dispatcher) Head() (cid.Cid, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.loadHead(); err != nil {
+		return cid.Undef, err
 	}
-	return nil
+	if d.head == nil {
+		return cid.Undef, nil
+	}
+	return cid.Cast(d.head)
 }
 
 // Query searches the internal event store and returns a query result.
 // This is a syncronouse version of github.com/ipfs/go-datastore's Query method
 func (d *Dispatcher) Query(query query.Query) ([]query.Entry, error) {
-	result, err := d.store.Query(query)
+	result, err := namespace.Wrap(d.store, eventsPrefix).Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -1,13 +1,26 @@
 package eventstore
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	cid "github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+	"github.com/textileio/go-eventstore/signature"
 )
 
 func TestNewEventDispatcher(t *testing.T) {
@@ -31,6 +44,7 @@ func TestDispatchLock(t *testing.T) {
 	dispatcher := NewDispatcher(eventstore)
 	dispatcher.Register(&slowReducer{})
 	event := core.NewNullEvent(time.Now())
+	other := core.NewNullEvent(time.Now().Add(time.Second))
 	t1 := time.Now()
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -40,7 +54,7 @@ func TestDispatchLock(t *testing.T) {
 			t.Error("unexpected error in dispatch call")
 		}
 	}()
-	if err := dispatcher.Dispatch(event); err != nil {
+	if err := dispatcher.Dispatch(other); err != nil {
 		t.Error("unexpected error in dispatch call")
 	}
 	wg.Wait()
@@ -65,7 +79,11 @@ func TestDispatch(t *testing.T) {
 		t.Errorf("expected 1 result, got %d", len(results))
 	}
 	dispatcher.Register(&errorReducer{})
-	err = dispatcher.Dispatch(event)
+	// Already persisted events are skipped
+	if err := dispatcher.Dispatch(event); err != nil {
+		t.Errorf("unexpected error in duplicate dispatch call: %v", err)
+	}
+	err = dispatcher.Dispatch(core.NewNullEvent(time.Now().Add(time.Second)))
 	if err == nil {
 		t.Error("expected error in dispatch call")
 	}
@@ -76,11 +94,54 @@ func TestDispatch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("query failed: %v", err)
 	}
-	if len(results) > 1 {
-		t.Errorf("expected 1 result, got %d", len(results))
+	if len(results) != 2 {
+		t.Errorf("expected 2 results, got %d", len(results))
+	}
+}
+
+func TestDispatchBatch(t *testing.T) {
+	eventstore := NewTxMapDatastore()
+	dispatcher := NewDispatcher(eventstore)
+	reducer := &orderReducer{}
+	dispatcher.Register(reducer)
+	var events []core.Event
+	n := 100
+	for i := 0; i < n; i++ {
+		events = append(events, core.NewNullEvent(time.Now().Add(time.Duration(i))))
+	}
+	// Duplicated events are persisted and reduced once
+	if err := dispatcher.DispatchBatch(append(events, events[0])); err != nil {
+		t.Fatalf("unexpected error in dispatch call: %v", err)
+	}
+	if len(reducer.events) != n {
+		t.Fatalf("expected %d reduced events, got %d", n, len(reducer.events))
+	}
+	for i := range events {
+		if reducer.events[i] != events[i] {
+			t.Fatal("events should be reduced in order")
+		}
+	}
+	entries, err := dispatcher.Events(context.Background(), 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Fatalf("expected %d persisted events, got %d", n, len(entries))
+	}
+	if err := dispatcher.Verify(); err != nil {
+		t.Fatalf("log should be valid: %v", err)
 	}
 }
 
+type orderReducer struct {
+	events []core.Event
+}
+
+func (r *orderReducer) Reduce(e core.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
 func TestValidStore(t *testing.T) {
 	eventstore := NewTxMapDatastore()
 	dispatcher := NewDispatcher(eventstore)
@@ -117,3 +178,501 @@ func TestDispatcherQuery(t *testing.T) {
 		t.Errorf("expected %d result, got %d", n, len(results))
 	}
 }
+
+func TestDispatcherVerify(t *testing.T) {
+	setup := func(t *testing.T, n int) *Dispatcher {
+		dispatcher := NewDispatcher(NewTxMapDatastore())
+		for i := 0; i < n; i++ {
+			if err := dispatcher.Dispatch(core.NewNullEvent(time.Now())); err != nil {
+				t.Fatalf("unexpected error in dispatch call: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return dispatcher
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		dispatcher := setup(t, 0)
+		if head, err := dispatcher.Head(); err != nil || head.Defined() {
+			t.Fatal("empty log should have undefined head")
+		}
+		var heads []cid.Cid
+		for i := 0; i < 5; i++ {
+			if err := dispatcher.Dispatch(core.NewNullEvent(time.Now())); err != nil {
+				t.Fatalf("unexpected error in dispatch call: %v", err)
+			}
+			head, err := dispatcher.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range heads {
+				if h.Equals(head) {
+					t.Fatal("head should change on every dispatch")
+				}
+			}
+			heads = append(heads, head)
+			time.Sleep(time.Millisecond)
+		}
+		if err := dispatcher.Verify(); err != nil {
+			t.Fatalf("log should be valid: %v", err)
+		}
+	})
+	t.Run("Reload", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		head, err := dispatcher.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloaded := NewDispatcher(dispatcher.Store())
+		rhead, err := reloaded.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !head.Equals(rhead) {
+			t.Fatal("reloaded dispatcher should have the same head")
+		}
+		if err := reloaded.Verify(); err != nil {
+			t.Fatalf("log should be valid: %v", err)
+		}
+	})
+	t.Run("Modified", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		key := datastore.RawKey(string(getValue(t, dispatcher, seqKey(3))))
+		rec, _, err := decodeRecord(getValue(t, dispatcher, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Event.Payload = []byte("tampered")
+		b := bytes.Buffer{}
+		b.WriteByte(byte(GobEncoding))
+		if err := gob.NewEncoder(&b).Encode(rec); err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Store().Put(key, b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		assertChainError(t, dispatcher.Verify(), 4)
+	})
+	t.Run("Removed", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		if err := dispatcher.Store().Delete(seqKey(2)); err != nil {
+			t.Fatal(err)
+		}
+		assertChainError(t, dispatcher.Verify(), 2)
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		key := datastore.RawKey(string(getValue(t, dispatcher, seqKey(5))))
+		if err := dispatcher.Store().Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Store().Delete(seqKey(5)); err != nil {
+			t.Fatal(err)
+		}
+		assertChainError(t, dispatcher.Verify(), 5)
+	})
+	t.Run("TruncatedReload", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		key := datastore.RawKey(string(getValue(t, dispatcher, seqKey(5))))
+		if err := dispatcher.Store().Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Store().Delete(seqKey(5)); err != nil {
+			t.Fatal(err)
+		}
+		assertChainError(t, NewDispatcher(dispatcher.Store()).Verify(), 5)
+	})
+	t.Run("ModifiedReload", func(t *testing.T) {
+		dispatcher := setup(t, 5)
+		key := datastore.RawKey(string(getValue(t, dispatcher, seqKey(5))))
+		rec, _, err := decodeRecord(getValue(t, dispatcher, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Event.Payload = []byte("tampered")
+		b, _, err := encodeRecord(GobEncoding, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Store().Put(key, b); err != nil {
+			t.Fatal(err)
+		}
+		assertChainError(t, NewDispatcher(dispatcher.Store()).Verify(), 5)
+	})
+	t.Run("MissingHead", func(t *testing.T) {
+		dispatcher := setup(t, 2)
+		if err := dispatcher.Store().Delete(headKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewDispatcher(dispatcher.Store()).Verify(); err != ErrMissingHead {
+			t.Fatalf("expected missing head error, got: %v", err)
+		}
+	})
+}
+
+// baselineEvent has the fields of the events persisted before the log was
+// hash-linked, which were gob encoded as they were.
+type baselineEvent struct {
+	Timestamp time.Time
+	ID        core.EntityID
+	TypeName  string
+	Patch     []byte
+}
+
+// putBaselineEvents persists events with the format used before the log
+// was hash-linked, returning their keys.
+func putBaselineEvents(t *testing.T, store datastore.Datastore, events ...baselineEvent) []datastore.Key {
+	keys := make([]datastore.Key, len(events))
+	for i, e := range events {
+		ts := new(bytes.Buffer)
+		checkErr(t, binary.Write(ts, binary.BigEndian, e.Timestamp.UnixNano()))
+		keys[i] = datastore.NewKey(ts.String()).ChildString(e.ID.String()).ChildString(e.TypeName)
+		b := bytes.Buffer{}
+		checkErr(t, gob.NewEncoder(&b).Encode(e))
+		checkErr(t, store.Put(keys[i], b.Bytes()))
+	}
+	return keys
+}
+
+func TestDispatcherLegacyLog(t *testing.T) {
+	store := NewTxMapDatastore()
+	now := time.Now()
+	id := core.NewEntityID()
+	keys := putBaselineEvents(t, store,
+		baselineEvent{Timestamp: now.Add(time.Second), ID: id, TypeName: "type", Patch: []byte("2")},
+		baselineEvent{Timestamp: now, ID: id, TypeName: "type", Patch: []byte("1")},
+	)
+	checkErr(t, store.Put(datastore.NewKey("/other"), []byte("value")))
+
+	dispatcher := NewDispatcher(store)
+	entries, err := dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	if len(entries) != 0 {
+		t.Fatal("legacy events should be indexed once the head is loaded")
+	}
+	checkErr(t, dispatcher.Verify())
+	entries, err = dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 legacy events, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.Seq != uint64(i+1) || string(e.Event.Body()) != strconv.Itoa(i+1) {
+			t.Fatalf("legacy events should be indexed in time order, got %d: %s", e.Seq, e.Event.Body())
+		}
+		if e.Event.EntityID() != id || e.Event.Type() != "type" || e.Key != keys[1-i] {
+			t.Fatalf("unexpected legacy event %s", e.Key)
+		}
+	}
+	for _, k := range keys {
+		if exists, err := store.Has(k); err != nil || exists {
+			t.Fatalf("legacy key %s should be removed, got: %v %v", k, exists, err)
+		}
+	}
+	if exists, err := store.Has(datastore.NewKey("/other")); err != nil || !exists {
+		t.Fatalf("other keys should be kept, got: %v %v", exists, err)
+	}
+
+	// Legacy events were already reduced by models, but not by other reducers
+	model, other := &orderReducer{}, &orderReducer{}
+	checkErr(t, dispatcher.Register(model, WithReducerName("model"), withLegacyReduced()))
+	checkErr(t, dispatcher.Register(other, WithReducerName("other")))
+	if len(model.events) != 0 || len(other.events) != 2 {
+		t.Fatalf("expected 0 and 2 caught up events, got %d and %d", len(model.events), len(other.events))
+	}
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(time.Now())))
+	reloaded := NewDispatcher(store)
+	checkErr(t, reloaded.Verify())
+	if seq, err := reloaded.LastSeq(); err != nil || seq != 3 {
+		t.Fatalf("expected last seq 3, got %d: %v", seq, err)
+	}
+}
+
+func TestDispatcherDAGCBOR(t *testing.T) {
+	eventstore := NewTxMapDatastore()
+	dispatcher := NewDispatcher(eventstore, WithEncoding(DAGCBOREncoding))
+	var heads []cid.Cid
+	for i := 0; i < 3; i++ {
+		if err := dispatcher.Dispatch(core.NewNullEvent(time.Now())); err != nil {
+			t.Fatalf("unexpected error in dispatch call: %v", err)
+		}
+		head, err := dispatcher.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Type() != cid.DagCBOR {
+			t.Fatalf("head should be a dag-cbor cid, got %s", head)
+		}
+		heads = append(heads, head)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Events are plain dag-cbor nodes linking their parent by CID
+	key := datastore.RawKey(string(getValue(t, dispatcher, seqKey(3))))
+	b := getValue(t, dispatcher, key)
+	if Encoding(b[0]) != DAGCBOREncoding {
+		t.Fatal("record should be tagged as dag-cbor")
+	}
+	n, err := cbornode.Decode(b[1:], mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.Cid().Equals(heads[2]) {
+		t.Fatal("node cid should match the head")
+	}
+	links := n.Links()
+	if len(links) != 1 || !links[0].Cid.Equals(heads[1]) {
+		t.Fatal("node should link to its parent")
+	}
+	if err := dispatcher.Verify(); err != nil {
+		t.Fatalf("log should be valid: %v", err)
+	}
+
+	// Switching encodings keeps the log linked
+	mixed := NewDispatcher(eventstore, WithEncoding(GobEncoding))
+	if err := mixed.Dispatch(core.NewNullEvent(time.Now())); err != nil {
+		t.Fatalf("unexpected error in dispatch call: %v", err)
+	}
+	if err := mixed.Verify(); err != nil {
+		t.Fatalf("mixed log should be valid: %v", err)
+	}
+}
+
+func TestGobRecordID(t *testing.T) {
+	t.Parallel()
+	rec := record{Seq: 1, Event: loggedEvent{
+		ID:       core.NewEntityID(),
+		TypeName: "type",
+		Meta: core.Metadata{
+			Headers: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+			Version: core.VectorClock{"a": 1, "b": 2, "c": 3, "d": 4},
+		},
+	}}
+	_, expected, err := encodeRecord(DAGCBOREncoding, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Gob encodes maps in random order, but the record CID doesn't change
+	for i := 0; i < 20; i++ {
+		b, id, err := encodeRecord(GobEncoding, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !id.Equals(expected) {
+			t.Fatalf("gob record should be identified by its dag-cbor cid %s, got %s", expected, id)
+		}
+		decoded, did, err := decodeRecord(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !did.Equals(expected) || !reflect.DeepEqual(decoded, rec) {
+			t.Fatalf("decoded record should be the encoded one, got %+v with cid %s", decoded, did)
+		}
+	}
+}
+
+func TestSignedEventReload(t *testing.T) {
+	t.Parallel()
+	signer, err := signature.GenerateEd25519Signer()
+	checkErr(t, err)
+	verifier := signature.NewEd25519Verifier(signer.PublicKey())
+	for _, enc := range []Encoding{GobEncoding, DAGCBOREncoding} {
+		store := NewTxMapDatastore()
+		e, err := core.SignEvent(&testEvent{
+			Timestamp: time.Now(),
+			ID:        core.NewEntityID(),
+			TypeName:  "type",
+			Payload:   []byte("body"),
+			Meta:      core.Metadata{Headers: map[string]string{}, Version: core.VectorClock{}},
+		}, signer)
+		checkErr(t, err)
+		checkErr(t, NewDispatcher(store, WithEncoding(enc)).Dispatch(e))
+
+		// Empty maps are decoded as nil once persisted
+		entries, err := NewDispatcher(store).Events(context.Background(), 0, 0, nil)
+		checkErr(t, err)
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 event, got %d", len(entries))
+		}
+		if err := core.VerifyEvent(entries[0].Event, verifier); err != nil {
+			t.Fatalf("persisted event with encoding %d should be verified: %v", enc, err)
+		}
+	}
+}
+
+func TestDispatcherEvents(t *testing.T) {
+	for _, enc := range []Encoding{GobEncoding, DAGCBOREncoding} {
+		dispatcher := NewDispatcher(NewTxMapDatastore(), WithEncoding(enc))
+		signer, err := signature.GenerateEd25519Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []core.Event
+		for i := 0; i < 6; i++ {
+			md := core.Metadata{ActorID: fmt.Sprintf("actor%d", i), Headers: map[string]string{"i": fmt.Sprint(i)}}
+			e := core.Event(&testEvent{
+				Timestamp: time.Now(),
+				ID:        core.NewEntityID(),
+				TypeName:  fmt.Sprintf("type%d", i%2),
+				Payload:   []byte(fmt.Sprintf("body%d", i)),
+				Meta:      md,
+			})
+			if i == 5 {
+				if e, err = core.SignEvent(e, signer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dispatcher.Dispatch(e); err != nil {
+				t.Fatalf("unexpected error in dispatch call: %v", err)
+			}
+			events = append(events, e)
+			time.Sleep(time.Millisecond)
+		}
+
+		entries, err := dispatcher.Events(context.Background(), 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(events) {
+			t.Fatalf("expected %d events, got %d", len(events), len(entries))
+		}
+		for i, entry := range entries {
+			e := events[i]
+			if entry.Seq != uint64(i+1) {
+				t.Fatalf("expected seq %d, got %d", i+1, entry.Seq)
+			}
+			if !entry.Key.Equal(eventKey(e)) {
+				t.Fatalf("unexpected event key %s", entry.Key)
+			}
+			if !bytes.Equal(entry.Event.Time(), e.Time()) || entry.Event.EntityID() != e.EntityID() ||
+				entry.Event.Type() != e.Type() || !bytes.Equal(entry.Event.Body(), e.Body()) ||
+				!reflect.DeepEqual(entry.Event.Metadata(), e.Metadata()) {
+				t.Fatalf("decoded event %d doesn't match the dispatched one", i)
+			}
+		}
+		if err := core.VerifyEvent(entries[5].Event, signature.NewEd25519Verifier(signer.PublicKey())); err != nil {
+			t.Fatalf("decoded signed event should be valid: %v", err)
+		}
+
+		entries, err = dispatcher.Events(context.Background(), 2, 5, ByType("type1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Seq != 2 || entries[1].Seq != 4 {
+			t.Fatalf("unexpected filtered events: %v", entries)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err = dispatcher.Events(ctx, 0, 0, nil); err != context.Canceled {
+			t.Fatalf("expected canceled context error, got: %v", err)
+		}
+	}
+}
+
+type testEvent struct {
+	Timestamp time.Time
+	ID        core.EntityID
+	TypeName  string
+	Payload   []byte
+	Meta      core.Metadata
+}
+
+func (e *testEvent) Body() []byte {
+	return e.Payload
+}
+
+func (e *testEvent) Time() []byte {
+	return core.NewNullEvent(e.Timestamp).Time()
+}
+
+func (e *testEvent) EntityID() core.EntityID {
+	return e.ID
+}
+
+func (e *testEvent) Type() string {
+	return e.TypeName
+}
+
+func (e *testEvent) Metadata() core.Metadata {
+	return e.Meta
+}
+
+func getValue(t *testing.T, d *Dispatcher, key datastore.Key) []byte {
+	t.Helper()
+	v, err := d.Store().Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func assertChainError(t *testing.T, err error, seq uint64) {
+	t.Helper()
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) {
+		t.Fatalf("expected chain error, got: %v", err)
+	}
+	if chainErr.Seq != seq {
+		t.Fatalf("expected broken link at seq %d, got %d", seq, chainErr.Seq)
+	}
+}
+
+func TestDispatcherClock(t *testing.T) {
+	t.Parallel()
+	// Node a clock is an hour ahead of node b
+	newStore := func(skew time.Duration) *Store {
+		clock := core.NewHLCWithSource(func() time.Time { return time.Now().Add(skew) })
+		dispatcher := NewDispatcher(NewTxMapDatastore(), WithClock(clock))
+		return NewStore(datastore.NewMapDatastore(), dispatcher, jsonpatcher.New())
+	}
+	t.Run("DispatcherClock", func(t *testing.T) {
+		t.Parallel()
+		assertCausalTimes(t, newStore(time.Hour), newStore(0))
+	})
+	t.Run("DefaultClocks", func(t *testing.T) {
+		t.Parallel()
+		b := NewStore(datastore.NewMapDatastore(), NewDispatcher(NewTxMapDatastore()), jsonpatcher.New())
+		assertCausalTimes(t, newStore(time.Hour), b)
+	})
+}
+
+// assertCausalTimes checks that events created by b after receiving the
+// events of a are ordered after them.
+func assertCausalTimes(t *testing.T, a, b *Store) {
+	t.Helper()
+	ma, err := a.Register("Person", &Person{})
+	checkErr(t, err)
+	mb, err := b.Register("Person", &Person{})
+	checkErr(t, err)
+	rec := &recorderReducer{}
+	checkErr(t, a.dispatcher.Register(rec))
+
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, ma.Create(p))
+	_, err = b.DispatchBatch(rec.events)
+	checkErr(t, err)
+	p.Age = 43
+	checkErr(t, mb.Save(p))
+
+	entries, err := b.dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(entries))
+	}
+	created, err := core.ParseTimestamp(entries[0].Event.Time())
+	checkErr(t, err)
+	if created.Wall < time.Now().Add(30*time.Minute).UnixNano() {
+		t.Fatalf("event %v should be stamped by the clock of its dispatcher", created)
+	}
+	saved, err := core.ParseTimestamp(entries[1].Event.Time())
+	checkErr(t, err)
+	if saved.Compare(created) <= 0 {
+		t.Fatalf("caused event %v should be after %v despite the clock skew", saved, created)
+	}
+	results, err := b.dispatcher.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	checkErr(t, err)
+	if results[0].Key != entries[0].Key.String() {
+		t.Fatal("events should be ordered by time as they were caused")
+	}
+}
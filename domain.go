@@ -0,0 +1,257 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	// ErrUnknownEvent indicates a domain event not registered in the model
+	ErrUnknownEvent = errors.New("unknown domain event")
+	// ErrUnknownCommand indicates a command not registered in the model
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+// EventReducer applies a domain event to an instance. It's called with a
+// pointer to the instance, or to a new one with just its ID if it doesn't
+// exist, and a pointer to the decoded event payload.
+type EventReducer func(instance interface{}, event interface{}) error
+
+// CommandHandler validates a command against the current instance, nil if
+// it doesn't exist, and returns the domain events it results in. It's
+// called with pointers to the instance and the command.
+type CommandHandler func(instance interface{}, cmd interface{}) ([]interface{}, error)
+
+// WithEvent registers a domain event named name, whose payloads have the
+// type of payload, and which is applied to instances with reducer. Domain
+// events record facts about an instance, e.g. a book being borrowed,
+// rather than changes to its state.
+func WithEvent(name string, payload interface{}, reducer EventReducer) ModelOption {
+	return func(m *Model) {
+		t := payloadType(payload)
+		m.events[name] = domainEventType{payload: t, reducer: reducer}
+		m.eventNames[t] = name
+		m.eventUpcasters(name)
+	}
+}
+
+// WithEventUpcaster registers the upcaster of payloads of the domain event
+// named name from version from into from+1. Domain events are emitted with
+// the latest version, which is 1 if they have no upcasters, and events of
+// older versions are upcasted when they're reduced.
+func WithEventUpcaster(name string, from int, u core.Upcaster) ModelOption {
+	return func(m *Model) {
+		m.eventUpcasters(name).Register(from, u)
+	}
+}
+
+// WithCommand registers the handler of commands with the type of cmd.
+func WithCommand(cmd interface{}, handler CommandHandler) ModelOption {
+	return func(m *Model) {
+		m.commands[payloadType(cmd)] = handler
+	}
+}
+
+// domainEventType is a domain event registered in a model.
+type domainEventType struct {
+	payload reflect.Type
+	reducer EventReducer
+}
+
+// Execute handles cmd for the instance with id, and commits the domain
+// events it results in.
+func (m *Model) Execute(id core.EntityID, cmd interface{}) error {
+	return m.WriteTxn(func(txn *Txn) error {
+		return txn.Execute(id, cmd)
+	})
+}
+
+// Execute handles cmd for the instance with id, and emits the domain events
+// it results in. The handler sees the instance as committed, without the
+// events emitted by the transaction.
+func (t *Txn) Execute(id core.EntityID, cmd interface{}) error {
+	if t.readonly {
+		return ErrReadonlyTx
+	}
+	handler, ok := t.model.commands[payloadType(cmd)]
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrUnknownCommand, cmd)
+	}
+	instance := reflect.New(t.model.valueType.Elem()).Interface()
+	err := t.FindByID(id, instance)
+	if err == ErrNotFound {
+		instance = nil
+	} else if err != nil {
+		return err
+	}
+	events, err := handler(instance, toPointer(cmd))
+	if err != nil {
+		return err
+	}
+	return t.Emit(id, events...)
+}
+
+// Emit adds domain events about the instance with id to the transaction.
+// They're dispatched on commit, after the events of the instances created,
+// saved or deleted by the transaction.
+func (t *Txn) Emit(id core.EntityID, events ...interface{}) error {
+	for _, e := range events {
+		if t.readonly {
+			return ErrReadonlyTx
+		}
+		name, ok := t.model.eventNames[payloadType(e)]
+		if !ok {
+			return fmt.Errorf("%w: %T", ErrUnknownEvent, e)
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		t.emitted = append(t.emitted, domainEvent{
+			ID:       id,
+			TypeName: t.model.domainEventType(name, t.model.upcasters[name].Current()),
+			Payload:  body,
+		})
+	}
+	return nil
+}
+
+// handles returns whether events with type t are about instances of m.
+func (m *Model) handles(t string) bool {
+	return t == m.schema.Ref || strings.HasPrefix(t, m.schema.Ref+"/")
+}
+
+// domainEventType returns the event type of domain events named name with
+// payloads of version. Types of the first version have no version suffix.
+func (m *Model) domainEventType(name string, version int) string {
+	t := m.schema.Ref + "/" + name
+	if version > 1 {
+		t += "@" + strconv.Itoa(version)
+	}
+	return t
+}
+
+// parseDomainEventType returns the name and payload version of domain
+// events with type t.
+func (m *Model) parseDomainEventType(t string) (string, int) {
+	name := strings.TrimPrefix(t, m.schema.Ref+"/")
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		if v, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i], v
+		}
+	}
+	return name, 1
+}
+
+// eventUpcasters returns the upcasters of domain events named name, which
+// are created as the model is configured.
+func (m *Model) eventUpcasters(name string) *core.Upcasters {
+	u, ok := m.upcasters[name]
+	if !ok {
+		u = core.NewUpcasters(1)
+		m.upcasters[name] = u
+	}
+	return u
+}
+
+// reduceInto applies event within txn to the instances of m kept under baseKey.
+func (m *Model) reduceInto(event core.Event, txn ds.Txn, baseKey ds.Key) error {
+	if event.Type() == m.schema.Ref {
+		return m.eventcodec.Reduce(event, txn, baseKey)
+	}
+	name, version := m.parseDomainEventType(event.Type())
+	et, ok := m.events[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+	}
+	body, err := m.upcasters[name].Upcast(version, event.Body())
+	if err != nil {
+		return fmt.Errorf("domain event %s: %w", name, err)
+	}
+	payload := reflect.New(et.payload).Interface()
+	if err := json.Unmarshal(body, payload); err != nil {
+		return err
+	}
+
+	key := baseKey.ChildString(event.EntityID().String())
+	instance := reflect.New(m.valueType.Elem()).Interface()
+	b, err := txn.Get(key)
+	switch {
+	case err == ds.ErrNotFound:
+		setEntityID(instance, event.EntityID())
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, instance); err != nil {
+			return err
+		}
+	}
+	if err := et.reducer(instance, payload); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(instance); err != nil {
+		return err
+	}
+	return txn.Put(key, b)
+}
+
+// domainEvent is an event created from a domain event payload.
+type domainEvent struct {
+	Timestamp core.Timestamp
+	ID        core.EntityID
+	TypeName  string
+	Payload   []byte
+	Meta      core.Metadata
+}
+
+func (de *domainEvent) Body() []byte {
+	return de.Payload
+}
+
+func (de *domainEvent) Time() []byte {
+	return de.Timestamp.Bytes()
+}
+
+func (de *domainEvent) EntityID() core.EntityID {
+	return de.ID
+}
+
+func (de *domainEvent) Type() string {
+	return de.TypeName
+}
+
+func (de *domainEvent) Metadata() core.Metadata {
+	return de.Meta
+}
+
+var _ core.Event = (*domainEvent)(nil)
+
+// payloadType returns the type of v, or the type it points to.
+func payloadType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// toPointer returns v if it's a pointer, or a pointer to a copy of v.
+func toPointer(v interface{}) interface{} {
+	if reflect.TypeOf(v).Kind() == reflect.Ptr {
+		return v
+	}
+	p := reflect.New(reflect.TypeOf(v))
+	p.Elem().Set(reflect.ValueOf(v))
+	return p.Interface()
+}
+
+func setEntityID(t interface{}, id core.EntityID) {
+	reflect.ValueOf(t).Elem().FieldByName(idFieldName).Set(reflect.ValueOf(id))
+}
@@ -0,0 +1,129 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+type loanedBook struct {
+	ID         core.EntityID
+	Title      string
+	BorrowedBy string
+	Loans      int
+}
+
+type bookBorrowed struct {
+	UserID string
+}
+
+type bookReturned struct{}
+
+type borrowBook struct {
+	UserID string
+}
+
+type returnBook struct{}
+
+var errAlreadyBorrowed = errors.New("book already borrowed")
+
+func registerLoans(t *testing.T, s *Store) *Model {
+	t.Helper()
+	m, err := s.Register("Book", &loanedBook{},
+		WithEvent("BookBorrowed", &bookBorrowed{}, func(instance, event interface{}) error {
+			b := instance.(*loanedBook)
+			b.BorrowedBy = event.(*bookBorrowed).UserID
+			b.Loans++
+			return nil
+		}),
+		WithEvent("BookReturned", &bookReturned{}, func(instance, _ interface{}) error {
+			instance.(*loanedBook).BorrowedBy = ""
+			return nil
+		}),
+		WithCommand(&borrowBook{}, func(instance, cmd interface{}) ([]interface{}, error) {
+			if b := instance.(*loanedBook); b.BorrowedBy != "" {
+				return nil, errAlreadyBorrowed
+			}
+			return []interface{}{bookBorrowed{UserID: cmd.(*borrowBook).UserID}}, nil
+		}),
+		WithCommand(&returnBook{}, func(instance, _ interface{}) ([]interface{}, error) {
+			return []interface{}{&bookReturned{}}, nil
+		}),
+	)
+	checkErr(t, err)
+	return m
+}
+
+func TestDomainEvents(t *testing.T) {
+	t.Parallel()
+	s := createTestStore()
+	m := registerLoans(t, s)
+	p, err := s.RegisterProjection("borrowers", ByModel(m), func(store ds.Datastore, a core.Action) error {
+		var b loanedBook
+		if err := json.Unmarshal(a.Current.(json.RawMessage), &b); err != nil {
+			return err
+		}
+		return store.Put(ds.NewKey(b.ID.String()), []byte(b.BorrowedBy))
+	})
+	checkErr(t, err)
+
+	b := &loanedBook{Title: "Title1"}
+	checkErr(t, m.Create(b))
+	checkErr(t, m.Execute(b.ID, &borrowBook{UserID: "alice"}))
+	assertLoanedBook(t, m, b.ID, "alice", 1)
+	if err := m.Execute(b.ID, borrowBook{UserID: "bob"}); err != errAlreadyBorrowed {
+		t.Fatalf("expected already borrowed error, got: %v", err)
+	}
+	if borrower, err := p.Datastore().Get(ds.NewKey(b.ID.String())); err != nil || string(borrower) != "alice" {
+		t.Fatalf("projection should see the borrower, got %q: %v", borrower, err)
+	}
+
+	checkErr(t, m.Execute(b.ID, returnBook{}))
+	checkErr(t, m.Execute(b.ID, borrowBook{UserID: "bob"}))
+	assertLoanedBook(t, m, b.ID, "bob", 2)
+
+	entries, err := s.dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(entries))
+	}
+	if e := entries[1].Event; e.Type() != m.schema.Ref+"/BookBorrowed" || string(e.Body()) != `{"UserID":"alice"}` {
+		t.Fatalf("unexpected domain event %s: %s", e.Type(), e.Body())
+	}
+
+	t.Run("Replicate", func(t *testing.T) {
+		target := createTestStore()
+		tm := registerLoans(t, target)
+		events := make([]core.Event, len(entries))
+		for i := range entries {
+			events[i] = entries[i].Event
+		}
+		_, err := target.DispatchBatch(events)
+		checkErr(t, err)
+		assertLoanedBook(t, tm, b.ID, "bob", 2)
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		if err := m.Execute(b.ID, &Person{}); !errors.Is(err, ErrUnknownCommand) {
+			t.Fatalf("expected unknown command error, got: %v", err)
+		}
+		err := m.WriteTxn(func(txn *Txn) error {
+			return txn.Emit(b.ID, &Person{})
+		})
+		if !errors.Is(err, ErrUnknownEvent) {
+			t.Fatalf("expected unknown event error, got: %v", err)
+		}
+	})
+}
+
+func assertLoanedBook(t *testing.T, m *Model, id core.EntityID, borrower string, loans int) {
+	t.Helper()
+	var b loanedBook
+	checkErr(t, m.FindByID(id, &b))
+	if b.BorrowedBy != borrower || b.Loans != loans {
+		t.Fatalf("expected book borrowed by %q %d times, got %q %d times", borrower, loans, b.BorrowedBy, b.Loans)
+	}
+}
@@ -0,0 +1,228 @@
+package eventstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/textileio/go-eventstore/core"
+)
+
+// Encoding identifies how records of the event log are serialized.
+type Encoding byte
+
+const (
+	// GobEncoding serializes records with encoding/gob. It's the default.
+	// Records are identified by the CID of their DAG-CBOR form, so they
+	// have the same CID with both encodings.
+	GobEncoding Encoding = iota + 1
+	// DAGCBOREncoding serializes records as IPLD DAG-CBOR nodes, so they
+	// can be exchanged with non-Go peers and stored in IPFS blockstores.
+	DAGCBOREncoding
+)
+
+var (
+	errUnknownEncoding = errors.New("unknown event log encoding")
+)
+
+func init() {
+	cbornode.RegisterCborType(cborMetadata{})
+	cbornode.RegisterCborType(cborEvent{})
+	cbornode.RegisterCborType(cborRecord{})
+}
+
+// recordEncoder serializes records of the event log. Every encoded record
+// is identified by a CID, which is what records use to link their parent.
+type recordEncoder interface {
+	encode(rec record) ([]byte, error)
+	decode(data []byte) (record, error)
+	id(data []byte) (cid.Cid, error)
+}
+
+func encoderFor(enc Encoding) (recordEncoder, error) {
+	switch enc {
+	case GobEncoding:
+		return gobEncoder{}, nil
+	case DAGCBOREncoding:
+		return cborEncoder{}, nil
+	default:
+		return nil, errUnknownEncoding
+	}
+}
+
+// encodeRecord serializes rec with enc. The result is prefixed with enc,
+// so records can be decoded regardless the current encoding.
+func encodeRecord(enc Encoding, rec record) ([]byte, cid.Cid, error) {
+	e, err := encoderFor(enc)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	data, err := e.encode(rec)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	id, err := e.id(data)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	return append([]byte{byte(enc)}, data...), id, nil
+}
+
+// decodeRecord deserializes a persisted record, returning it with its CID.
+func decodeRecord(b []byte) (record, cid.Cid, error) {
+	if len(b) == 0 {
+		return record{}, cid.Undef, errUnknownEncoding
+	}
+	e, err := encoderFor(Encoding(b[0]))
+	if err != nil {
+		return record{}, cid.Undef, err
+	}
+	rec, err := e.decode(b[1:])
+	if err != nil {
+		return record{}, cid.Undef, err
+	}
+	id, err := e.id(b[1:])
+	if err != nil {
+		return record{}, cid.Undef, err
+	}
+	return rec, id, nil
+}
+
+type gobEncoder struct{}
+
+func (gobEncoder) encode(rec record) ([]byte, error) {
+	rb := bytes.Buffer{}
+	if err := gob.NewEncoder(&rb).Encode(rec); err != nil {
+		return nil, err
+	}
+	return rb.Bytes(), nil
+}
+
+func (gobEncoder) decode(data []byte) (record, error) {
+	var rec record
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec)
+	return rec, err
+}
+
+// id returns the CID of the DAG-CBOR form of the record in data. Gob
+// encodes maps in iteration order, which is random, and numbers types in
+// the order each process first encodes them, so the same record can be
+// encoded differently by each node, while its DAG-CBOR form is canonical.
+func (e gobEncoder) id(data []byte) (cid.Cid, error) {
+	rec, err := e.decode(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	var c cborEncoder
+	b, err := c.encode(rec)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return c.id(b)
+}
+
+type cborMetadata struct {
+	EventID       string            `refmt:"eventId,omitempty"`
+	ActorID       string            `refmt:"actorId,omitempty"`
+	CorrelationID string            `refmt:"correlationId,omitempty"`
+	CausationID   string            `refmt:"causationId,omitempty"`
+	Headers       map[string]string `refmt:"headers,omitempty"`
+	Version       map[string]uint64 `refmt:"version,omitempty"`
+	Origin        string            `refmt:"origin,omitempty"`
+}
+
+type cborEvent struct {
+	Time      []byte       `refmt:"time"`
+	EntityID  string       `refmt:"entityId"`
+	Type      string       `refmt:"type"`
+	Body      []byte       `refmt:"body"`
+	Metadata  cborMetadata `refmt:"metadata"`
+	PublicKey []byte       `refmt:"publicKey,omitempty"`
+	Signature []byte       `refmt:"signature,omitempty"`
+}
+
+type cborRecord struct {
+	Seq   uint64    `refmt:"seq"`
+	Prev  *cid.Cid  `refmt:"prev,omitempty"`
+	Event cborEvent `refmt:"event"`
+}
+
+type cborEncoder struct{}
+
+func (cborEncoder) encode(rec record) ([]byte, error) {
+	cr := cborRecord{
+		Seq: rec.Seq,
+		Event: cborEvent{
+			Time:     rec.Event.Timestamp,
+			EntityID: rec.Event.ID.String(),
+			Type:     rec.Event.TypeName,
+			Body:     rec.Event.Payload,
+			Metadata: cborMetadata{
+				EventID:       rec.Event.Meta.EventID,
+				ActorID:       rec.Event.Meta.ActorID,
+				CorrelationID: rec.Event.Meta.CorrelationID,
+				CausationID:   rec.Event.Meta.CausationID,
+				Headers:       rec.Event.Meta.Headers,
+				Version:       rec.Event.Meta.Version,
+				Origin:        rec.Event.Meta.Origin,
+			},
+			PublicKey: rec.Event.Key,
+			Signature: rec.Event.Sig,
+		},
+	}
+	if rec.Prev != nil {
+		prev, err := cid.Cast(rec.Prev)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous record cid: %v", err)
+		}
+		cr.Prev = &prev
+	}
+	n, err := cbornode.WrapObject(cr, mh.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	return n.RawData(), nil
+}
+
+func (cborEncoder) decode(data []byte) (record, error) {
+	var cr cborRecord
+	if err := cbornode.DecodeInto(data, &cr); err != nil {
+		return record{}, err
+	}
+	rec := record{
+		Seq: cr.Seq,
+		Event: loggedEvent{
+			Timestamp: cr.Event.Time,
+			ID:        core.EntityID(cr.Event.EntityID),
+			TypeName:  cr.Event.Type,
+			Payload:   cr.Event.Body,
+			Meta: core.Metadata{
+				EventID:       cr.Event.Metadata.EventID,
+				ActorID:       cr.Event.Metadata.ActorID,
+				CorrelationID: cr.Event.Metadata.CorrelationID,
+				CausationID:   cr.Event.Metadata.CausationID,
+				Headers:       cr.Event.Metadata.Headers,
+				Version:       cr.Event.Metadata.Version,
+				Origin:        cr.Event.Metadata.Origin,
+			},
+			Key: cr.Event.PublicKey,
+			Sig: cr.Event.Signature,
+		},
+	}
+	if cr.Prev != nil {
+		rec.Prev = cr.Prev.Bytes()
+	}
+	return rec, nil
+}
+
+func (cborEncoder) id(data []byte) (cid.Cid, error) {
+	h, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.DagCBOR, h), nil
+}
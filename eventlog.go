@@ -0,0 +1,463 @@
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	eventsPrefix   = datastore.NewKey("/events")
+	seqPrefix      = datastore.NewKey("/seq")
+	eventIDsPrefix = datastore.NewKey("/ids")
+	headKey        = datastore.NewKey("/head")
+
+	// ErrEventNotFound indicates there's no event with the given ID in the log
+	ErrEventNotFound = errors.New("event not found")
+	// ErrMissingHead indicates the log has records but its head wasn't found
+	ErrMissingHead = errors.New("event log head is missing")
+)
+
+// record is the persisted form of an event in the log.
+type record struct {
+	// Seq is the position of the event in the log, starting at 1
+	Seq uint64
+	// Prev is the CID of the previous record, nil for the first one
+	Prev []byte
+	// Event is the persisted event
+	Event loggedEvent
+}
+
+// loggedEvent is the encoding-agnostic form of persisted events. Whatever
+// the original event type was, it's decoded back as a loggedEvent.
+type loggedEvent struct {
+	Timestamp []byte
+	ID        core.EntityID
+	TypeName  string
+	Payload   []byte
+	Meta      core.Metadata
+	Key       []byte
+	Sig       []byte
+}
+
+func newLoggedEvent(e core.Event) loggedEvent {
+	le := loggedEvent{
+		Timestamp: e.Time(),
+		ID:        e.EntityID(),
+		TypeName:  e.Type(),
+		Payload:   e.Body(),
+		Meta:      e.Metadata(),
+	}
+	if se, ok := e.(core.SignedEvent); ok {
+		le.Key = se.PublicKey()
+		le.Sig = se.Signature()
+	}
+	return le
+}
+
+func (le *loggedEvent) Body() []byte {
+	return le.Payload
+}
+
+func (le *loggedEvent) Time() []byte {
+	return le.Timestamp
+}
+
+func (le *loggedEvent) EntityID() core.EntityID {
+	return le.ID
+}
+
+func (le *loggedEvent) Type() string {
+	return le.TypeName
+}
+
+func (le *loggedEvent) Metadata() core.Metadata {
+	return le.Meta
+}
+
+func (le *loggedEvent) PublicKey() []byte {
+	return le.Key
+}
+
+func (le *loggedEvent) Signature() []byte {
+	return le.Sig
+}
+
+var _ core.SignedEvent = (*loggedEvent)(nil)
+
+// LogEntry is an event read from the log.
+type LogEntry struct {
+	// Seq is the position of the event in the log
+	Seq uint64
+	// Key is the key of the event, as returned by Query
+	Key datastore.Key
+	// Event is the decoded event
+	Event core.Event
+}
+
+// EventFilter selects which events are read from the log.
+type EventFilter func(e core.Event) bool
+
+// ByType returns an EventFilter which selects events of any of the given types.
+func ByType(types ...string) EventFilter {
+	return func(e core.Event) bool {
+		for _, t := range types {
+			if e.Type() == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ChainError reports the first broken link found while verifying the log.
+type ChainError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("broken event log at seq %d: %s", e.Seq, e.Reason)
+}
+
+// Events returns the events in the log with a sequence between from and to
+// (both inclusive) accepted by filter, in the order they were persisted.
+// A zero to reads up to the end of the log, and a nil filter accepts every event.
+// Events are decoded with the encoding they were persisted with.
+func (d *Dispatcher) Events(ctx context.Context, from, to uint64, filter EventFilter) ([]LogEntry, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.events(ctx, from, to, filter)
+}
+
+func (d *Dispatcher) events(ctx context.Context, from, to uint64, filter EventFilter) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := d.scan(ctx, from, func(seq uint64, key datastore.Key, b []byte) (bool, error) {
+		if to != 0 && seq > to {
+			return false, nil
+		}
+		rec, _, err := decodeRecord(b)
+		if err != nil {
+			return false, fmt.Errorf("error when decoding event %d: %v", seq, err)
+		}
+		if filter == nil || filter(&rec.Event) {
+			entries = append(entries, LogEntry{
+				Seq:   seq,
+				Key:   datastore.RawKey(strings.TrimPrefix(key.String(), eventsPrefix.String())),
+				Event: &rec.Event,
+			})
+		}
+		return true, nil
+	})
+	return entries, err
+}
+
+// scan calls fn with the sequence, key and encoded record of every event in
+// the log from the given sequence, in order, until fn returns false or fails.
+func (d *Dispatcher) scan(ctx context.Context, from uint64, fn func(seq uint64, key datastore.Key, b []byte) (bool, error)) error {
+	q := query.Query{
+		Prefix: seqPrefix.String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	}
+	if from > 1 {
+		q.Filters = []query.Filter{query.FilterKeyCompare{
+			Op:  query.GreaterThanOrEqual,
+			Key: seqKey(from).String(),
+		}}
+	}
+	res, err := d.store.Query(q)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if r.Error != nil {
+			return r.Error
+		}
+		seq, err := parseSeqKey(r.Key)
+		if err != nil {
+			return err
+		}
+		key := datastore.RawKey(string(r.Value))
+		b, err := d.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok, err := fn(seq, key, b); !ok || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify walks the event log from the beginning checking every record is
+// linked to the previous one, and the last one to the current head.
+// The head is persisted with every write to the log, so records removed
+// or modified at the end of the log are detected after restarts too.
+// It returns a *ChainError describing the first broken link found.
+func (d *Dispatcher) Verify() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.loadHead(); err != nil {
+		return err
+	}
+	res, err := d.store.Query(query.Query{
+		Prefix: seqPrefix.String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	var prev []byte
+	var expected uint64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		expected++
+		seq, err := parseSeqKey(r.Key)
+		if err != nil {
+			return err
+		}
+		if seq != expected {
+			return &ChainError{Seq: expected, Reason: "missing record"}
+		}
+		b, err := d.store.Get(datastore.RawKey(string(r.Value)))
+		if err == datastore.ErrNotFound {
+			return &ChainError{Seq: seq, Reason: "missing event"}
+		}
+		if err != nil {
+			return err
+		}
+		rec, id, err := decodeRecord(b)
+		if err != nil {
+			return &ChainError{Seq: seq, Reason: fmt.Sprintf("undecodable record: %v", err)}
+		}
+		if rec.Seq != seq {
+			return &ChainError{Seq: seq, Reason: "sequence mismatch"}
+		}
+		if !bytes.Equal(rec.Prev, prev) {
+			return &ChainError{Seq: seq, Reason: "previous record mismatch"}
+		}
+		prev = id.Bytes()
+	}
+	if expected != d.seq {
+		return &ChainError{Seq: d.seq, Reason: "log truncated"}
+	}
+	if !bytes.Equal(prev, d.head) {
+		return &ChainError{Seq: d.seq, Reason: "head mismatch"}
+	}
+	return nil
+}
+
+// logWriter is the common interface of datastore batches and transactions
+// used to write records.
+type logWriter interface {
+	Put(key datastore.Key, value []byte) error
+	Commit() error
+}
+
+// newWriter returns a batch of the store, or a transaction if it doesn't
+// support batching. discard must be called once done with it.
+func (d *Dispatcher) newWriter() (logWriter, func(), error) {
+	if bds, ok := d.store.(datastore.Batching); ok {
+		b, err := bds.Batch()
+		if err != nil {
+			return nil, nil, err
+		}
+		return b, func() {}, nil
+	}
+	txn, err := d.store.NewTransaction(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return txn, txn.Discard, nil
+}
+
+// append persists events as the next records of the log in a single write,
+// returning the sequence assigned to each of them. Events which were already
+// persisted, with the same key or EventID, aren't appended again: they get
+// their original sequence and the Duplicate status.
+func (d *Dispatcher) append(events []core.Event) ([]uint64, []DispatchStatus, error) {
+	if err := d.loadHead(); err != nil {
+		return nil, nil, err
+	}
+	w, discard, err := d.newWriter()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer discard()
+
+	seqs := make([]uint64, len(events))
+	statuses := make([]DispatchStatus, len(events))
+	seq, head := d.seq, d.head
+	batched := make(map[string]uint64)
+	for i, event := range events {
+		key := eventsPrefix.Child(eventKey(event))
+		eventID := event.Metadata().EventID
+		bseq, ok := batched[key.String()]
+		if !ok && eventID != "" {
+			bseq, ok = batched[eventID]
+		}
+		if ok {
+			seqs[i], statuses[i] = bseq, Duplicate
+			continue
+		}
+		pseq, err := d.persistedSeq(key, eventID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pseq != 0 {
+			seqs[i], statuses[i] = pseq, Duplicate
+			continue
+		}
+		// Encode and add an Event to event store
+		rec := record{Seq: seq + 1, Prev: head, Event: newLoggedEvent(event)}
+		b, id, err := encodeRecord(d.encoding, rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := w.Put(key, b); err != nil {
+			return nil, nil, err
+		}
+		if err := w.Put(seqKey(rec.Seq), []byte(key.String())); err != nil {
+			return nil, nil, err
+		}
+		if eventID != "" {
+			if err := w.Put(eventIDsPrefix.ChildString(eventID), []byte(key.String())); err != nil {
+				return nil, nil, err
+			}
+			batched[eventID] = rec.Seq
+		}
+		seq, head = rec.Seq, id.Bytes()
+		batched[key.String()] = seq
+		seqs[i], statuses[i] = seq, Dispatched
+	}
+	if seq == d.seq {
+		return seqs, statuses, nil
+	}
+	if err := w.Put(headKey, encodeHead(seq, head)); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Commit(); err != nil {
+		return nil, nil, err
+	}
+	d.seq, d.head = seq, head
+	return seqs, statuses, nil
+}
+
+// EventByID returns the event persisted with eventID.
+func (d *Dispatcher) EventByID(eventID string) (LogEntry, error) {
+	k, err := d.store.Get(eventIDsPrefix.ChildString(eventID))
+	if err == datastore.ErrNotFound {
+		return LogEntry{}, ErrEventNotFound
+	}
+	if err != nil {
+		return LogEntry{}, err
+	}
+	b, err := d.store.Get(datastore.RawKey(string(k)))
+	if err != nil {
+		return LogEntry{}, err
+	}
+	rec, _, err := decodeRecord(b)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	return LogEntry{
+		Seq:   rec.Seq,
+		Key:   datastore.RawKey(strings.TrimPrefix(string(k), eventsPrefix.String())),
+		Event: &rec.Event,
+	}, nil
+}
+
+// persistedSeq returns the sequence of the event persisted with key
+// or with eventID, or zero if there's none.
+func (d *Dispatcher) persistedSeq(key datastore.Key, eventID string) (uint64, error) {
+	b, err := d.store.Get(key)
+	if err == datastore.ErrNotFound && eventID != "" {
+		var k []byte
+		if k, err = d.store.Get(eventIDsPrefix.ChildString(eventID)); err == nil {
+			b, err = d.store.Get(datastore.RawKey(string(k)))
+		}
+	}
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rec, _, err := decodeRecord(b)
+	if err != nil {
+		return 0, err
+	}
+	return rec.Seq, nil
+}
+
+// loadHead initializes the in-memory head from the persisted one. Logs
+// without a head are either empty, or written before the log was
+// hash-linked, in which case their events are indexed first.
+func (d *Dispatcher) loadHead() error {
+	if d.loaded {
+		return nil
+	}
+	if err := d.loadMigrated(); err != nil {
+		return err
+	}
+	b, err := d.store.Get(headKey)
+	if err == datastore.ErrNotFound {
+		return d.migrateLegacy()
+	}
+	if err != nil {
+		return err
+	}
+	seq, head, err := decodeHead(b)
+	if err != nil {
+		return err
+	}
+	d.seq, d.head = seq, head
+	d.loaded = true
+	return nil
+}
+
+// encodeHead serializes the sequence and CID of the last record.
+func encodeHead(seq uint64, head []byte) []byte {
+	b := make([]byte, 8, 8+len(head))
+	binary.BigEndian.PutUint64(b, seq)
+	return append(b, head...)
+}
+
+func decodeHead(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, fmt.Errorf("invalid event log head")
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// eventKey returns the key of event relative to the events namespace.
+// Key format: <timestamp>/<entity-id>/<type>
+// @todo: This is up for debate, its a 'fake' Event struct right now anyway
+func eventKey(event core.Event) datastore.Key {
+	return datastore.NewKey(string(event.Time())).ChildString(event.EntityID().String()).ChildString(event.Type())
+}
+
+func seqKey(seq uint64) datastore.Key {
+	return seqPrefix.ChildString(fmt.Sprintf("%020d", seq))
+}
+
+func parseSeqKey(k string) (uint64, error) {
+	return strconv.ParseUint(datastore.RawKey(k).BaseNamespace(), 10, 64)
+}
@@ -0,0 +1,247 @@
+// Package eventstoretest provides conformance tests for the datastores
+// backing an eventstore.Store and its eventstore.Dispatcher.
+package eventstoretest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// DatastoreFactory returns a new empty datastore. The suite closes it once
+// done with it.
+type DatastoreFactory func(t *testing.T) datastore.TxnDatastore
+
+// RunDatastoreSuite checks a TxnDatastore behaves as the Store and the
+// Dispatcher assume, running each test on a new datastore from factory:
+//
+//   - Reads of missing keys fail with datastore.ErrNotFound.
+//   - Writes of transactions and batches are applied at once on Commit,
+//     and none of them after Discard.
+//   - Transactions read their own pending writes, while other readers
+//     don't see them until committed.
+//   - Queries can be ordered by key, both ascending and descending, and
+//     combined with key filters and limits.
+//   - Queries with a prefix only return the keys under it.
+//
+// It's meant to be called from the tests of a backend, e.g.:
+//
+//	func TestConformance(t *testing.T) {
+//		eventstoretest.RunDatastoreSuite(t, func(t *testing.T) datastore.TxnDatastore {
+//			return newBackend(t)
+//		})
+//	}
+func RunDatastoreSuite(t *testing.T, factory DatastoreFactory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, d datastore.TxnDatastore)
+	}{
+		{"Basic", testBasic},
+		{"Atomicity", testAtomicity},
+		{"Batch", testBatch},
+		{"Isolation", testIsolation},
+		{"ReadYourWrites", testReadYourWrites},
+		{"KeyOrder", testKeyOrder},
+		{"Prefix", testPrefix},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d := factory(t)
+			defer d.Close()
+			tt.run(t, d)
+		})
+	}
+}
+
+func testBasic(t *testing.T, d datastore.TxnDatastore) {
+	key := datastore.NewKey("/a")
+	if _, err := d.Get(key); err != datastore.ErrNotFound {
+		t.Fatalf("expected not found error getting a missing key, got: %v", err)
+	}
+	if _, err := d.GetSize(key); err != datastore.ErrNotFound {
+		t.Fatalf("expected not found error getting the size of a missing key, got: %v", err)
+	}
+	put(t, d, "/a", "1")
+	assertValue(t, d, "/a", "1")
+	if size, err := d.GetSize(key); err != nil || size != 1 {
+		t.Fatalf("expected size 1, got: %v %v", size, err)
+	}
+	put(t, d, "/a", "2")
+	assertValue(t, d, "/a", "2")
+	checkErr(t, d.Delete(key))
+	assertMissing(t, d, "/a")
+	checkErr(t, d.Delete(key))
+}
+
+func testAtomicity(t *testing.T, d datastore.TxnDatastore) {
+	put(t, d, "/a", "1")
+	txn, err := d.NewTransaction(false)
+	checkErr(t, err)
+	put(t, txn, "/a", "2")
+	put(t, txn, "/b", "2")
+	checkErr(t, txn.Delete(datastore.NewKey("/c")))
+	assertValue(t, d, "/a", "1")
+	assertMissing(t, d, "/b")
+	checkErr(t, txn.Commit())
+	txn.Discard()
+	assertValue(t, d, "/a", "2")
+	assertValue(t, d, "/b", "2")
+
+	txn, err = d.NewTransaction(false)
+	checkErr(t, err)
+	put(t, txn, "/a", "3")
+	checkErr(t, txn.Delete(datastore.NewKey("/b")))
+	txn.Discard()
+	assertValue(t, d, "/a", "2")
+	assertValue(t, d, "/b", "2")
+}
+
+func testBatch(t *testing.T, d datastore.TxnDatastore) {
+	bds, ok := d.(datastore.Batching)
+	if !ok {
+		t.Skip("datastore doesn't support batching")
+	}
+	put(t, d, "/c", "1")
+	b, err := bds.Batch()
+	checkErr(t, err)
+	put(t, b, "/a", "1")
+	put(t, b, "/b", "1")
+	checkErr(t, b.Delete(datastore.NewKey("/c")))
+	assertMissing(t, d, "/a")
+	checkErr(t, b.Commit())
+	assertValue(t, d, "/a", "1")
+	assertValue(t, d, "/b", "1")
+	assertMissing(t, d, "/c")
+}
+
+func testIsolation(t *testing.T, d datastore.TxnDatastore) {
+	put(t, d, "/a", "1")
+	writer, err := d.NewTransaction(false)
+	checkErr(t, err)
+	defer writer.Discard()
+	put(t, writer, "/a", "2")
+	put(t, writer, "/b", "2")
+
+	reader, err := d.NewTransaction(true)
+	checkErr(t, err)
+	defer reader.Discard()
+	assertValue(t, reader, "/a", "1")
+	assertMissing(t, reader, "/b")
+	assertKeys(t, reader, query.Query{}, "/a")
+	assertKeys(t, d, query.Query{}, "/a")
+}
+
+func testReadYourWrites(t *testing.T, d datastore.TxnDatastore) {
+	put(t, d, "/a", "1")
+	put(t, d, "/b", "1")
+	txn, err := d.NewTransaction(false)
+	checkErr(t, err)
+	defer txn.Discard()
+	put(t, txn, "/a", "2")
+	put(t, txn, "/c", "2")
+	checkErr(t, txn.Delete(datastore.NewKey("/b")))
+	assertValue(t, txn, "/a", "2")
+	assertValue(t, txn, "/c", "2")
+	assertMissing(t, txn, "/b")
+	assertKeys(t, txn, query.Query{}, "/a", "/c")
+}
+
+func testKeyOrder(t *testing.T, d datastore.TxnDatastore) {
+	// Keys are zero padded, as the Dispatcher does with sequences
+	var keys []string
+	for _, i := range []int{3, 10, 1, 7, 2, 9, 4, 6, 8, 5} {
+		put(t, d, fmt.Sprintf("/seq/%020d", i), "")
+	}
+	for i := 1; i <= 10; i++ {
+		keys = append(keys, fmt.Sprintf("/seq/%020d", i))
+	}
+	assertKeys(t, d, query.Query{Orders: []query.Order{query.OrderByKey{}}}, keys...)
+	assertKeys(t, d, query.Query{
+		Orders: []query.Order{query.OrderByKeyDescending{}},
+		Limit:  1,
+	}, keys[9])
+	assertKeys(t, d, query.Query{
+		Orders: []query.Order{query.OrderByKey{}},
+		Filters: []query.Filter{query.FilterKeyCompare{
+			Op:  query.GreaterThanOrEqual,
+			Key: keys[6],
+		}},
+	}, keys[6:]...)
+}
+
+func testPrefix(t *testing.T, d datastore.TxnDatastore) {
+	for _, k := range []string{"/a", "/a/b", "/a/b/c", "/a/d", "/b", "/b/a"} {
+		put(t, d, k, k)
+	}
+	order := []query.Order{query.OrderByKey{}}
+	assertKeys(t, d, query.Query{Prefix: "/a/", Orders: order}, "/a/b", "/a/b/c", "/a/d")
+	assertKeys(t, d, query.Query{Prefix: "/a/b/", Orders: order}, "/a/b/c")
+	assertKeys(t, d, query.Query{Prefix: "/c/", Orders: order})
+
+	res, err := d.Query(query.Query{Prefix: "/b/"})
+	checkErr(t, err)
+	entries, err := res.Rest()
+	checkErr(t, err)
+	if len(entries) != 1 || entries[0].Key != "/b/a" || string(entries[0].Value) != "/b/a" {
+		t.Fatalf("expected the entry of /b/a, got %v", entries)
+	}
+}
+
+func put(t *testing.T, w datastore.Write, key, value string) {
+	t.Helper()
+	checkErr(t, w.Put(datastore.NewKey(key), []byte(value)))
+}
+
+func assertValue(t *testing.T, r datastore.Read, key, expected string) {
+	t.Helper()
+	v, err := r.Get(datastore.NewKey(key))
+	checkErr(t, err)
+	if string(v) != expected {
+		t.Fatalf("expected %s to be %q, got %q", key, expected, v)
+	}
+}
+
+func assertMissing(t *testing.T, r datastore.Read, key string) {
+	t.Helper()
+	if _, err := r.Get(datastore.NewKey(key)); err != datastore.ErrNotFound {
+		t.Fatalf("expected %s to be missing, got: %v", key, err)
+	}
+	if exists, err := r.Has(datastore.NewKey(key)); err != nil || exists {
+		t.Fatalf("expected %s to be missing, got: %v %v", key, exists, err)
+	}
+}
+
+// assertKeys checks the keys returned by q, in order if q has orders.
+func assertKeys(t *testing.T, r datastore.Read, q query.Query, expected ...string) {
+	t.Helper()
+	q.KeysOnly = true
+	res, err := r.Query(q)
+	checkErr(t, err)
+	entries, err := res.Rest()
+	checkErr(t, err)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	if len(q.Orders) == 0 {
+		sort.Strings(keys)
+	}
+	if len(keys) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
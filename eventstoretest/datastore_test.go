@@ -0,0 +1,37 @@
+package eventstoretest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	es "github.com/textileio/go-eventstore"
+)
+
+func TestTxMapDatastore(t *testing.T) {
+	t.Parallel()
+	RunDatastoreSuite(t, func(*testing.T) datastore.TxnDatastore {
+		return es.NewTxMapDatastore()
+	})
+}
+
+func TestJournaledTxMapDatastore(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "eventstoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var n int
+	RunDatastoreSuite(t, func(t *testing.T) datastore.TxnDatastore {
+		n++
+		d, err := es.OpenTxMapDatastore(filepath.Join(dir, fmt.Sprintf("journal%d", n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
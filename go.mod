@@ -8,10 +8,13 @@ require (
 	github.com/evanphx/json-patch v4.5.0+incompatible
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/go-multierror v1.0.0
+	github.com/ipfs/go-cid v0.0.3
 	github.com/ipfs/go-datastore v0.1.1
+	github.com/ipfs/go-ipld-cbor v0.0.3
 	github.com/ipfs/go-log v0.0.1
 	github.com/jbenet/goprocess v0.1.3 // indirect
 	github.com/mattn/go-isatty v0.0.7 // indirect
+	github.com/multiformats/go-multihash v0.0.10
 	github.com/opentracing/opentracing-go v1.1.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/xeipuuv/gojsonschema v1.2.0
@@ -1,12 +1,9 @@
 package jsonpatcher
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	ds "github.com/ipfs/go-datastore"
@@ -29,19 +26,101 @@ var (
 	errUnknownOperation           = errors.New("unknown operation type")
 )
 
+// operationVersion is the version of the operations encoded in new events.
+// Operations of version 1 have no Version, and hold patches base64 encoded.
+const operationVersion = 2
+
 type operation struct {
+	Version   int `json:",omitempty"`
+	Type      operationType
+	EntityID  core.EntityID
+	JSONPatch json.RawMessage `json:",omitempty"`
+	// Undo is the merge patch restoring the previous instance, which is the
+	// whole instance for deletes. It's nil for creates, and older events.
+	Undo json.RawMessage `json:",omitempty"`
+}
+
+// operationV1 is the format of operations of version 1.
+type operationV1 struct {
 	Type      operationType
 	EntityID  core.EntityID
 	JSONPatch []byte
+	Undo      []byte `json:",omitempty"`
+}
+
+// upcasters transform older operations into the current version.
+var upcasters = core.NewUpcasters(operationVersion)
+
+func init() {
+	upcasters.Register(1, func(body []byte) ([]byte, error) {
+		var v1 operationV1
+		if err := json.Unmarshal(body, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(operation{
+			Version:   2,
+			Type:      v1.Type,
+			EntityID:  v1.EntityID,
+			JSONPatch: v1.JSONPatch,
+			Undo:      v1.Undo,
+		})
+	})
+}
+
+// decodeOperation decodes the operation of an event body of any version.
+func decodeOperation(body []byte) (operation, error) {
+	var op operation
+	var versioned struct{ Version int }
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return op, err
+	}
+	if versioned.Version == 0 {
+		versioned.Version = 1
+	}
+	body, err := upcasters.Upcast(versioned.Version, body)
+	if err != nil {
+		return op, err
+	}
+	err = json.Unmarshal(body, &op)
+	return op, err
 }
 
 type patcher struct {
+	clock core.Clock
 }
 
 var _ core.EventCodec = (*patcher)(nil)
+var _ core.Reverter = (*patcher)(nil)
+var _ core.Clocked = (*patcher)(nil)
+
+// Option configures optional behavior of the codec.
+type Option func(*patcher)
 
-func New() core.EventCodec {
-	return &patcher{}
+// WithClock sets the clock used to stamp events. By default, each codec
+// has its own hybrid logical clock, which the store shares with its
+// dispatcher unless the dispatcher has a clock already.
+func WithClock(c core.Clock) Option {
+	return func(p *patcher) {
+		p.clock = c
+	}
+}
+
+func New(opts ...Option) core.EventCodec {
+	p := &patcher{clock: core.NewHLC()}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Clock returns the clock used to stamp events.
+func (m *patcher) Clock() core.Clock {
+	return m.clock
+}
+
+// SetClock replaces the clock used to stamp events.
+func (m *patcher) SetClock(c core.Clock) {
+	m.clock = c
 }
 
 func (m *patcher) Create(actions []core.Action) ([]core.Event, error) {
@@ -55,7 +134,7 @@ func (m *patcher) Create(actions []core.Action) ([]core.Event, error) {
 		case core.Save:
 			eventPayload, err = saveEvent(actions[i].EntityID, actions[i].Previous, actions[i].Current)
 		case core.Delete:
-			eventPayload, err = deleteEvent(actions[i].EntityID)
+			eventPayload, err = deleteEvent(actions[i].EntityID, actions[i].Previous)
 		default:
 			panic("unkown action type")
 		}
@@ -63,37 +142,38 @@ func (m *patcher) Create(actions []core.Action) ([]core.Event, error) {
 			return nil, err
 		}
 		events[i] = patchEvent{
-			Timestamp: time.Now(),
+			Timestamp: m.clock.Now(),
 			ID:        actions[i].EntityID,
 			TypeName:  actions[i].EntityType,
 			Patch:     eventPayload,
+			Meta:      actions[i].Metadata,
 		}
 	}
 	return events, nil
 }
 
-func (p *patcher) Reduce(e core.Event, datastore ds.Datastore, baseKey ds.Key) error {
-	var op operation
-	if err := json.Unmarshal(e.Body(), &op); err != nil {
+func (p *patcher) Reduce(e core.Event, txn ds.Txn, baseKey ds.Key) error {
+	op, err := decodeOperation(e.Body())
+	if err != nil {
 		return err
 	}
 
 	key := baseKey.ChildString(e.EntityID().String())
 	switch op.Type {
 	case create:
-		exist, err := datastore.Has(key)
+		exist, err := txn.Has(key)
 		if err != nil {
 			return err
 		}
 		if exist {
 			return errCantCreateExistingInstance
 		}
-		if err := datastore.Put(key, op.JSONPatch); err != nil {
+		if err := txn.Put(key, op.JSONPatch); err != nil {
 			return fmt.Errorf("error when reducing create event: %v", err)
 		}
 		log.Debug("\tcreate operation applied")
 	case save:
-		value, err := datastore.Get(key)
+		value, err := txn.Get(key)
 		if errors.Is(err, ds.ErrNotFound) {
 			return errSavingNonExistentInstance
 		}
@@ -104,12 +184,12 @@ func (p *patcher) Reduce(e core.Event, datastore ds.Datastore, baseKey ds.Key) e
 		if err != nil {
 			return fmt.Errorf("error when reducing save event: %v", err)
 		}
-		if err = datastore.Put(key, patchedValue); err != nil {
+		if err = txn.Put(key, patchedValue); err != nil {
 			return err
 		}
 		log.Debug("\tsave operation applied")
 	case delete:
-		if err := datastore.Delete(key); err != nil {
+		if err := txn.Delete(key); err != nil {
 			return err
 		}
 		log.Debug("\tdelete operation applied")
@@ -120,12 +200,46 @@ func (p *patcher) Reduce(e core.Event, datastore ds.Datastore, baseKey ds.Key) e
 	return nil
 }
 
+// Revert returns the instance restoring over current the changes done by e.
+// Saved fields are restored to their previous values, keeping fields
+// changed afterwards, and deleted instances are restored as they were.
+func (p *patcher) Revert(e core.Event, current []byte) ([]byte, error) {
+	op, err := decodeOperation(e.Body())
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Type {
+	case create:
+		return nil, nil
+	case save:
+		if op.Undo == nil {
+			return nil, core.ErrNotRevertible
+		}
+		if current == nil {
+			return nil, errSavingNonExistentInstance
+		}
+		return jsonpatch.MergePatch(current, op.Undo)
+	case delete:
+		if op.Undo == nil {
+			return nil, core.ErrNotRevertible
+		}
+		if current != nil {
+			return nil, errCantCreateExistingInstance
+		}
+		return op.Undo, nil
+	default:
+		return nil, errUnknownOperation
+	}
+}
+
 func createEvent(id core.EntityID, v interface{}) ([]byte, error) {
 	opBytes, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
 	op := operation{
+		Version:   operationVersion,
 		Type:      create,
 		EntityID:  id,
 		JSONPatch: opBytes,
@@ -150,10 +264,16 @@ func saveEvent(id core.EntityID, prev interface{}, curr interface{}) ([]byte, er
 	if err != nil {
 		return nil, err
 	}
+	undo, err := jsonpatch.CreateMergePatch(currBytes, prevBytes)
+	if err != nil {
+		return nil, err
+	}
 	op := operation{
+		Version:   operationVersion,
 		Type:      save,
 		EntityID:  id,
 		JSONPatch: jsonPatch,
+		Undo:      undo,
 	}
 	eventPayload, err := json.Marshal(op)
 	if err != nil {
@@ -162,12 +282,21 @@ func saveEvent(id core.EntityID, prev interface{}, curr interface{}) ([]byte, er
 	return eventPayload, nil
 }
 
-func deleteEvent(id core.EntityID) ([]byte, error) {
+func deleteEvent(id core.EntityID, prev interface{}) ([]byte, error) {
 	op := operation{
+		Version:   operationVersion,
 		Type:      delete,
 		EntityID:  id,
 		JSONPatch: nil,
 	}
+	// The removed instance is kept, so the delete can be reverted
+	if prev != nil {
+		prevBytes, err := json.Marshal(prev)
+		if err != nil {
+			return nil, err
+		}
+		op.Undo = prevBytes
+	}
 	eventPayload, err := json.Marshal(op)
 	if err != nil {
 		return nil, err
@@ -176,10 +305,11 @@ func deleteEvent(id core.EntityID) ([]byte, error) {
 }
 
 type patchEvent struct {
-	Timestamp time.Time
+	Timestamp core.Timestamp
 	ID        core.EntityID
 	TypeName  string
 	Patch     []byte
+	Meta      core.Metadata
 }
 
 func (je patchEvent) Body() []byte {
@@ -187,11 +317,7 @@ func (je patchEvent) Body() []byte {
 }
 
 func (je patchEvent) Time() []byte {
-	t := je.Timestamp.UnixNano()
-	buf := new(bytes.Buffer)
-	// Use big endian to preserve lexicographic sorting
-	binary.Write(buf, binary.BigEndian, t)
-	return buf.Bytes()
+	return je.Timestamp.Bytes()
 }
 
 func (je patchEvent) EntityID() core.EntityID {
@@ -202,4 +328,8 @@ func (je patchEvent) Type() string {
 	return je.TypeName
 }
 
+func (je patchEvent) Metadata() core.Metadata {
+	return je.Meta
+}
+
 var _ core.Event = (*patchEvent)(nil)
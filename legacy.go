@@ -0,0 +1,133 @@
+package eventstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"strconv"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	migratedKey = datastore.NewKey("/migrated")
+)
+
+// legacyEvent is the format of the events persisted before the log was
+// hash-linked: the gob encoded jsonpatcher events, stored in the root of
+// the datastore with their key, as returned by eventKey.
+type legacyEvent struct {
+	Timestamp time.Time
+	ID        core.EntityID
+	TypeName  string
+	Patch     []byte
+}
+
+// decodeLegacyEvent returns the event persisted with key in the legacy
+// format, or false if it isn't one.
+func decodeLegacyEvent(key string, b []byte) (core.Event, bool) {
+	var le legacyEvent
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&le); err != nil {
+		return nil, false
+	}
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(le.Timestamp.UnixNano()))
+	e := &loggedEvent{
+		Timestamp: ts,
+		ID:        le.ID,
+		TypeName:  le.TypeName,
+		Payload:   le.Patch,
+	}
+	// Values which happen to decode are discarded unless they were
+	// persisted with the key of the decoded event
+	if eventKey(e).String() != key {
+		return nil, false
+	}
+	return e, true
+}
+
+// migrateLegacy indexes the events persisted in the legacy format, if any,
+// as the first records of an empty log, in the order of their keys, which
+// is their time order. Their original keys are removed once indexed.
+// Legacy events were already reduced by the models of the store, which
+// is recorded so they aren't reduced again when registered.
+func (d *Dispatcher) migrateLegacy() error {
+	res, err := d.store.Query(query.Query{
+		Prefix:   seqPrefix.String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrMissingHead
+	}
+
+	keys, events, err := d.legacyEvents()
+	if err != nil {
+		return err
+	}
+	d.loaded = true
+	if len(events) == 0 {
+		return nil
+	}
+	log.Infof("indexing %d events of legacy event log", len(events))
+	// Legacy keys are unique, so they're appended as 1..len(events)
+	migrated := uint64(len(events))
+	if err := d.store.Put(migratedKey, []byte(strconv.FormatUint(migrated, 10))); err != nil {
+		return err
+	}
+	if _, _, err := d.append(events); err != nil {
+		d.loaded = false
+		return err
+	}
+	d.migrated = migrated
+	for _, k := range keys {
+		if err := d.store.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyEvents returns the keys and events persisted in the legacy format.
+func (d *Dispatcher) legacyEvents() ([]datastore.Key, []core.Event, error) {
+	res, err := d.store.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Close()
+	var keys []datastore.Key
+	var events []core.Event
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, nil, r.Error
+		}
+		if e, ok := decodeLegacyEvent(r.Key, r.Value); ok {
+			keys = append(keys, datastore.RawKey(r.Key))
+			events = append(events, e)
+		}
+	}
+	return keys, events, nil
+}
+
+// loadMigrated loads the sequence of the last event migrated from a legacy log.
+func (d *Dispatcher) loadMigrated() error {
+	b, err := d.store.Get(migratedKey)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.migrated, err = strconv.ParseUint(string(b), 10, 64)
+	return err
+}
@@ -1,9 +1,12 @@
 package eventstore
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/jsonschema"
 	ds "github.com/ipfs/go-datastore"
@@ -32,6 +35,15 @@ type Model struct {
 	dispatcher   *Dispatcher
 	dsKey        ds.Key
 	store        *Store
+	resolver     ConflictResolver
+	events       map[string]domainEventType
+	eventNames   map[reflect.Type]string
+	commands     map[reflect.Type]CommandHandler
+	upcasters    map[string]*core.Upcasters
+	policy       *RetryPolicy
+
+	issuedLock sync.Mutex
+	issued     map[core.EntityID]core.VectorClock
 }
 
 func NewModel(name string, defaultInstance interface{}, datastore ds.Datastore, dispatcher *Dispatcher, eventcreator core.EventCodec, s *Store) *Model {
@@ -46,6 +58,12 @@ func NewModel(name string, defaultInstance interface{}, datastore ds.Datastore,
 		eventcodec:   eventcreator,
 		dsKey:        baseKey.ChildString(name),
 		store:        s,
+		resolver:     MergeFields,
+		issued:       make(map[core.EntityID]core.VectorClock),
+		events:       make(map[string]domainEventType),
+		eventNames:   make(map[reflect.Type]string),
+		commands:     make(map[reflect.Type]CommandHandler),
+		upcasters:    make(map[string]*core.Upcasters),
 	}
 
 	return m
@@ -56,7 +74,13 @@ func (m *Model) ReadTxn(f func(txn *Txn) error) error {
 }
 
 func (m *Model) WriteTxn(f func(txn *Txn) error) error {
-	return m.store.writeTxn(m, f)
+	return m.store.writeTxn(context.Background(), m, f)
+}
+
+// WriteTxnContext is like WriteTxn, but generated events carry the
+// metadata found in ctx (see core.ContextWithMetadata).
+func (m *Model) WriteTxnContext(ctx context.Context, f func(txn *Txn) error) error {
+	return m.store.writeTxn(ctx, m, f)
 }
 
 func (m *Model) FindByID(id core.EntityID, v interface{}) error {
@@ -99,12 +123,57 @@ func (m *Model) Find(result interface{}, q *Query) error {
 
 func (m *Model) Reduce(event core.Event) error {
 	log.Debugf("reducer %s start", m.schema.Ref)
-	if event.Type() != m.schema.Ref {
+	if !m.handles(event.Type()) {
 		log.Debugf("ignoring event from uninteresting type")
 		return nil
 	}
 
-	return m.eventcodec.Reduce(event, m.datastore, m.dsKey)
+	// Transactions conflicting with concurrent ones didn't write anything,
+	// and reduce the event again over the instances they changed
+	backoff := conflictRetryPolicy.Backoff
+	for attempts := 1; ; attempts++ {
+		err := m.reduceTxn(event)
+		if err != ErrTxnConflict || attempts >= conflictRetryPolicy.MaxAttempts {
+			return err
+		}
+		log.Debugf("reducer %s conflicted, retrying", m.schema.Ref)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > conflictRetryPolicy.MaxBackoff {
+			backoff = conflictRetryPolicy.MaxBackoff
+		}
+	}
+}
+
+// reduceTxn reduces event within a single transaction, so every key
+// written for the event is committed together.
+func (m *Model) reduceTxn(event core.Event) error {
+	txn, err := m.newTxn()
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	if err := m.reduceTo(event, txn, m.dsKey); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// reduceTo applies event within txn to the instances of m kept under
+// baseKey. Concurrent updates of versioned events are resolved.
+func (m *Model) reduceTo(event core.Event, txn ds.Txn, baseKey ds.Key) error {
+	if len(event.Metadata().Version) == 0 {
+		return m.reduceInto(event, txn, baseKey)
+	}
+	return m.reduceVersioned(event, txn, baseKey)
+}
+
+// newTxn returns a transaction of the model datastore. Datastores without
+// transactions get a SimpleTx.
+func (m *Model) newTxn() (ds.Txn, error) {
+	if tds, ok := m.datastore.(ds.TxnDatastore); ok {
+		return tds.NewTransaction(false)
+	}
+	return NewSimpleTx(m.datastore), nil
 }
 
 func (m *Model) validInstance(v interface{}) (bool, error) {
@@ -125,7 +194,21 @@ type Txn struct {
 	commited  bool
 	readonly  bool
 
-	actions []core.Action
+	actions   []core.Action
+	emitted   []domainEvent
+	metadata  core.Metadata
+	versioned []core.EntityID
+}
+
+// SetMetadata sets the metadata attached to every event generated by
+// the transaction on commit.
+func (t *Txn) SetMetadata(md core.Metadata) {
+	t.metadata = md
+}
+
+// Metadata returns the metadata attached to events generated by the transaction.
+func (t *Txn) Metadata() core.Metadata {
+	return t.metadata
 }
 
 // Create creates new instances in the model
@@ -213,18 +296,24 @@ func (t *Txn) Delete(ids ...core.EntityID) error {
 			return ErrReadonlyTx
 		}
 		key := t.model.dsKey.ChildString(ids[i].String())
-		exists, err := t.model.datastore.Has(key)
+		beforeBytes, err := t.model.datastore.Get(key)
+		if err == ds.ErrNotFound {
+			return ErrNotFound
+		}
 		if err != nil {
 			return err
 		}
-		if !exists {
-			return ErrNotFound
+
+		before := reflect.New(t.model.valueType.Elem()).Interface()
+		err = json.Unmarshal(beforeBytes, before)
+		if err != nil {
+			return err
 		}
 		a := core.Action{
 			Type:       core.Delete,
 			EntityID:   ids[i],
 			EntityType: t.model.schema.Ref,
-			Previous:   nil,
+			Previous:   before,
 			Current:    nil,
 		}
 		t.actions = append(t.actions, a)
@@ -263,17 +352,60 @@ func (t *Txn) Commit() error {
 		return errAlreadyDiscardedCommitedTxn
 	}
 
+	replica, err := t.model.store.ReplicaID()
+	if err != nil {
+		return err
+	}
+	// Write transactions are serialized, and wait for the model to reduce
+	// the events of previous ones, so issued clocks aren't needed after
+	// the commit, whether it succeeds or not
+	defer func() { t.model.releaseVersions(t.versioned) }()
+	for i := range t.actions {
+		causation := t.actions[i].Metadata.CausationID
+		if t.actions[i].Metadata, err = t.eventMetadata(t.actions[i].EntityID, replica); err != nil {
+			return err
+		}
+		// Compensating actions are caused by the event they revert
+		if causation != "" {
+			t.actions[i].Metadata.CausationID = causation
+		}
+	}
 	events, err := t.model.eventcodec.Create(t.actions)
 	if err != nil {
 		return err
 	}
-
-	for _, e := range events {
-		if err := t.model.dispatcher.Dispatch(e); err != nil {
+	for i := range t.emitted {
+		e := &t.emitted[i]
+		if e.Meta, err = t.eventMetadata(e.ID, replica); err != nil {
 			return err
 		}
+		e.Timestamp = t.model.store.clock.Now()
+		events = append(events, e)
 	}
-	return nil
+	if signer := t.model.store.signer; signer != nil {
+		for i := range events {
+			if events[i], err = core.SignEvent(events[i], signer); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = t.model.dispatcher.dispatchBatch(events)
+	return err
+}
+
+// eventMetadata returns the metadata of a new event of the instance with id.
+func (t *Txn) eventMetadata(id core.EntityID, replica string) (core.Metadata, error) {
+	md := t.metadata
+	md.EventID = core.NewEventID()
+	md.Origin = replica
+	version, err := t.model.nextVersion(id, replica)
+	if err != nil {
+		return md, err
+	}
+	md.Version = version
+	t.versioned = append(t.versioned, id)
+	return md, nil
 }
 
 func (t *Txn) Discard() {
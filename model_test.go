@@ -1,9 +1,13 @@
 package eventstore
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"os"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 
 	ds "github.com/ipfs/go-datastore"
@@ -364,6 +368,234 @@ func TestInvalidActions(t *testing.T) {
 	})
 }
 
+func TestEventMetadata(t *testing.T) {
+	t.Parallel()
+
+	t.Run("FromContext", func(t *testing.T) {
+		t.Parallel()
+		store := createTestStore()
+		m, err := store.Register("Person", &Person{})
+		checkErr(t, err)
+		rec := &recorderReducer{}
+		store.dispatcher.Register(rec)
+
+		md := core.Metadata{
+			ActorID:       "alice",
+			CorrelationID: "req-1",
+			Headers:       map[string]string{"origin": "test"},
+		}
+		ctx := core.ContextWithMetadata(context.Background(), md)
+		err = m.WriteTxnContext(ctx, func(txn *Txn) error {
+			return txn.Create(&Person{Name: "Foo", Age: 42})
+		})
+		checkErr(t, err)
+		if len(rec.events) != 1 || !reflect.DeepEqual(userMetadata(t, rec.events[0]), md) {
+			t.Fatalf("reduced event should carry context metadata")
+		}
+	})
+	t.Run("FromTxn", func(t *testing.T) {
+		t.Parallel()
+		store := createTestStore()
+		m, err := store.Register("Person", &Person{})
+		checkErr(t, err)
+		rec := &recorderReducer{}
+		store.dispatcher.Register(rec)
+
+		md := core.Metadata{ActorID: "bob", CausationID: "cmd-1"}
+		err = m.WriteTxn(func(txn *Txn) error {
+			txn.SetMetadata(md)
+			return txn.Create(&Person{Name: "Foo", Age: 42}, &Person{Name: "Bar", Age: 43})
+		})
+		checkErr(t, err)
+		if len(rec.events) != 2 {
+			t.Fatalf("expected 2 reduced events, got %d", len(rec.events))
+		}
+		for _, e := range rec.events {
+			if !reflect.DeepEqual(userMetadata(t, e), md) {
+				t.Fatalf("reduced event should carry txn metadata")
+			}
+		}
+		if rec.events[0].Metadata().EventID == rec.events[1].Metadata().EventID {
+			t.Fatal("events should have different IDs")
+		}
+	})
+}
+
+func TestReduceTxn(t *testing.T) {
+	t.Parallel()
+	datastore := NewTxMapDatastore()
+	store := NewStore(datastore, NewDispatcher(NewTxMapDatastore()), &indexingCodec{EventCodec: jsonpatcher.New()})
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+	assertPersonInModel(t, m, p)
+	id, err := datastore.Get(ds.NewKey("/index/Foo"))
+	checkErr(t, err)
+	if string(id) != p.ID.String() {
+		t.Fatalf("index should point to %s, got %s", p.ID, id)
+	}
+
+	// Keys written by a failed reduction aren't committed
+	failed := &Person{Name: "Fail", Age: 43}
+	if err := m.Create(failed); err != errIndexFailed {
+		t.Fatalf("expected index error, got: %v", err)
+	}
+	if exists, err := m.Has(failed.ID); err != nil || exists {
+		t.Fatalf("instance of failed reduction shouldn't exist, got: %v %v", exists, err)
+	}
+
+}
+
+func TestReduceTxnConflict(t *testing.T) {
+	t.Parallel()
+	codec := &barrierCodec{EventCodec: jsonpatcher.New()}
+	store := NewStore(NewTxMapDatastore(), NewDispatcher(NewTxMapDatastore()), codec)
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+	id := core.NewEntityID()
+	checkErr(t, m.Reduce(createRemoteEvent(t, m, core.Create, id, map[string]interface{}{"Name": "Foo", "Age": 42})))
+
+	// Both reductions read the instance before any of them commits
+	codec.hold(2)
+	errs := make(chan error, 2)
+	for _, age := range []int{43, 44} {
+		save := createRemoteEvent(t, m, core.Save, id, map[string]interface{}{"Name": "Foo", "Age": age})
+		go func() {
+			errs <- m.Reduce(save)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		checkErr(t, <-errs)
+	}
+}
+
+func TestReduceTxnConflictAttempts(t *testing.T) {
+	t.Parallel()
+	datastore := NewTxMapDatastore()
+	codec := &conflictingCodec{EventCodec: jsonpatcher.New(), datastore: datastore}
+	store := NewStore(datastore, NewDispatcher(NewTxMapDatastore()), codec)
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+
+	// Reductions which keep conflicting fail after the last attempt
+	create := createRemoteEvent(t, m, core.Create, core.NewEntityID(), map[string]interface{}{"Name": "Foo", "Age": 42})
+	if err := m.Reduce(create); err != ErrTxnConflict {
+		t.Fatalf("expected txn conflict error, got: %v", err)
+	}
+	if codec.calls != conflictRetryPolicy.MaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", conflictRetryPolicy.MaxAttempts, codec.calls)
+	}
+}
+
+// conflictingCodec writes a key read by the reduction transaction out of
+// it, so the transaction always conflicts.
+type conflictingCodec struct {
+	core.EventCodec
+	datastore ds.Datastore
+	calls     int
+}
+
+func (c *conflictingCodec) Reduce(e core.Event, txn ds.Txn, baseKey ds.Key) error {
+	if err := c.EventCodec.Reduce(e, txn, baseKey); err != nil {
+		return err
+	}
+	c.calls++
+	key := ds.NewKey("/conflict")
+	if _, err := txn.Get(key); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	return c.datastore.Put(key, []byte(strconv.Itoa(c.calls)))
+}
+
+// barrierCodec can hold reductions until a number of them are waiting,
+// so their transactions overlap.
+type barrierCodec struct {
+	core.EventCodec
+	lock    sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+// hold makes the next n reductions wait for each other.
+func (c *barrierCodec) hold(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.waiting, c.release = n, make(chan struct{})
+}
+
+func (c *barrierCodec) Reduce(e core.Event, txn ds.Txn, baseKey ds.Key) error {
+	if err := c.EventCodec.Reduce(e, txn, baseKey); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	release := c.release
+	if c.waiting > 0 {
+		if c.waiting--; c.waiting == 0 {
+			close(c.release)
+		}
+	}
+	c.lock.Unlock()
+	if release != nil {
+		<-release
+	}
+	return nil
+}
+
+var errIndexFailed = errors.New("index failed")
+
+// indexingCodec indexes instances by name along with reducing their events,
+// failing to index instances named Fail.
+type indexingCodec struct {
+	core.EventCodec
+}
+
+func (c *indexingCodec) Reduce(e core.Event, txn ds.Txn, baseKey ds.Key) error {
+	if err := c.EventCodec.Reduce(e, txn, baseKey); err != nil {
+		return err
+	}
+	b, err := txn.Get(baseKey.ChildString(e.EntityID().String()))
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var p Person
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.Name == "Fail" {
+		return errIndexFailed
+	}
+	return txn.Put(ds.NewKey("/index").ChildString(p.Name), []byte(p.ID))
+}
+
+// userMetadata returns the metadata of e without the fields set by
+// the store, which must be set.
+func userMetadata(t *testing.T, e core.Event) core.Metadata {
+	t.Helper()
+	md := e.Metadata()
+	if md.EventID == "" || len(md.Version) == 0 || md.Origin == "" {
+		t.Fatal("event should have an ID, a version and an origin")
+	}
+	md.EventID, md.Version, md.Origin = "", nil, ""
+	return md
+}
+
+type recorderReducer struct {
+	lock   sync.Mutex
+	events []core.Event
+}
+
+func (r *recorderReducer) Reduce(e core.Event) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
 func checkErr(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -381,9 +613,9 @@ func assertPersonInModel(t *testing.T, model *Model, person *Person) {
 	}
 }
 
-func createTestStore() *Store {
+func createTestStore(opts ...StoreOption) *Store {
 	datastore := ds.NewMapDatastore()
 	dispatcher := NewDispatcher(NewTxMapDatastore())
 	eventcodec := jsonpatcher.New()
-	return NewStore(datastore, dispatcher, eventcodec)
+	return NewStore(datastore, dispatcher, eventcodec, opts...)
 }
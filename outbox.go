@@ -0,0 +1,108 @@
+package eventstore
+
+import (
+	"context"
+)
+
+// Sink publishes events to a system outside the store.
+type Sink interface {
+	// Send publishes entry, returning once the system acknowledged it.
+	Send(ctx context.Context, entry LogEntry) error
+}
+
+// SinkFunc is an adapter to use an ordinary function as a Sink.
+type SinkFunc func(ctx context.Context, entry LogEntry) error
+
+// Send calls f(ctx, entry).
+func (f SinkFunc) Send(ctx context.Context, entry LogEntry) error {
+	return f(ctx, entry)
+}
+
+// Outbox publishes every persisted event to a Sink, in log order. The
+// offset of the last delivered event is tracked with a durable Subscription,
+// so an outbox started again with the same name resumes right after it.
+// Delivery is at least once: an event is sent again if the outbox stops
+// between its delivery and the offset update, so sinks should deduplicate
+// by the event key.
+type Outbox struct {
+	name   string
+	sink   Sink
+	sub    *Subscription
+	d      *Dispatcher
+	policy *RetryPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartOutbox starts an outbox named name, publishing events accepted by
+// filter to sink. A nil filter accepts every event. Failed deliveries are
+// retried until they succeed, or stored as dead letters of the outbox after
+// all the attempts of a RetryPolicy given with WithRetryPolicy.
+func (d *Dispatcher) StartOutbox(name string, filter EventFilter, sink Sink, opts ...ReducerOption) (*Outbox, error) {
+	reg := &registration{name: "outbox/" + name}
+	for _, opt := range opts {
+		opt(reg)
+	}
+	sub, err := d.Subscribe(reg.name, filter)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		name:   name,
+		sink:   sink,
+		sub:    sub,
+		d:      d,
+		policy: reg.policy,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+// Name returns the name of the outbox.
+func (o *Outbox) Name() string {
+	return o.name
+}
+
+// Offset returns the sequence of the last delivered event.
+func (o *Outbox) Offset() (uint64, error) {
+	return o.sub.Offset()
+}
+
+// Close stops the outbox, waiting for the delivery in progress.
+func (o *Outbox) Close() error {
+	o.cancel()
+	<-o.done
+	return o.sub.Close()
+}
+
+func (o *Outbox) run() {
+	defer close(o.done)
+	for {
+		e, err := o.sub.Next(o.ctx)
+		if err != nil {
+			if o.ctx.Err() == nil {
+				log.Errorf("error when reading events of outbox %s: %v", o.name, err)
+			}
+			return
+		}
+		err = o.d.retry(o.ctx, o.sub.Name(), e.Seq, o.policy, func() error {
+			return o.sink.Send(o.ctx, e)
+		})
+		if err != nil {
+			if o.ctx.Err() == nil {
+				log.Errorf("error when delivering event %d of outbox %s: %v", e.Seq, o.name, err)
+			}
+			return
+		}
+		if err := o.sub.Ack(e.Seq); err != nil {
+			log.Errorf("error when saving offset of outbox %s: %v", o.name, err)
+			return
+		}
+	}
+}
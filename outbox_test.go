@@ -0,0 +1,92 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))))
+	}
+
+	sink := &recorderSink{failures: 1}
+	outbox, err := dispatcher.StartOutbox("sink", nil, sink)
+	checkErr(t, err)
+	waitFor(t, func() bool { return len(sink.delivered()) == 3 })
+	checkErr(t, outbox.Close())
+	assertDelivered(t, sink, 1, 2, 3)
+	offset, err := outbox.Offset()
+	checkErr(t, err)
+	if offset != 3 {
+		t.Fatalf("expected offset 3, got %d", offset)
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(3))))
+		outbox, err := dispatcher.StartOutbox("sink", nil, sink)
+		checkErr(t, err)
+		defer outbox.Close()
+		waitFor(t, func() bool { return len(sink.delivered()) == 4 })
+		assertDelivered(t, sink, 1, 2, 3, 4)
+	})
+	t.Run("DeadLetters", func(t *testing.T) {
+		failing := SinkFunc(func(context.Context, LogEntry) error {
+			return errors.New("sink error")
+		})
+		outbox, err := dispatcher.StartOutbox("failing", nil, failing,
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}))
+		checkErr(t, err)
+		defer outbox.Close()
+		waitFor(t, func() bool {
+			letters, err := dispatcher.DeadLetters("outbox/failing")
+			checkErr(t, err)
+			return len(letters) == 4
+		})
+	})
+}
+
+// recorderSink records delivered events, failing the first deliveries.
+type recorderSink struct {
+	lock     sync.Mutex
+	failures int
+	seqs     []uint64
+}
+
+func (s *recorderSink) Send(_ context.Context, e LogEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink error")
+	}
+	s.seqs = append(s.seqs, e.Seq)
+	return nil
+}
+
+func (s *recorderSink) delivered() []uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]uint64(nil), s.seqs...)
+}
+
+func assertDelivered(t *testing.T, s *recorderSink, seqs ...uint64) {
+	t.Helper()
+	delivered := s.delivered()
+	if len(delivered) != len(seqs) {
+		t.Fatalf("expected %d delivered events, got %d", len(seqs), len(delivered))
+	}
+	for i := range seqs {
+		if delivered[i] != seqs[i] {
+			t.Fatalf("expected event %d delivered at %d, got %d", seqs[i], i, delivered[i])
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	projectionsPrefix = ds.NewKey("/projections")
+)
+
+// ProjectionHandler applies an action decoded from the event log to the
+// projection state, kept in the projection datastore. Previous and Current
+// values of the action are the JSON encoded instances, or nil if they
+// don't exist. Writes to store are discarded if the handler fails.
+type ProjectionHandler func(store ds.Datastore, action core.Action) error
+
+// Projection is a read model kept in sync with the event log. Projections
+// are registered as reducers, so they're checkpointed and catch up with
+// events persisted while they weren't registered.
+type Projection struct {
+	name       string
+	filter     EventFilter
+	handler    ProjectionHandler
+	eventcodec core.EventCodec
+	root       ds.Datastore
+	data       ds.Datastore
+	instances  ds.Datastore
+	dispatcher *Dispatcher
+	store      *Store
+	lock       sync.Mutex
+}
+
+// ByModel returns an EventFilter which selects events of the given models,
+// including their domain events.
+func ByModel(models ...*Model) EventFilter {
+	return func(e core.Event) bool {
+		for _, m := range models {
+			if m.handles(e.Type()) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RegisterProjection registers a projection named name, whose handler is called
+// with every action of events accepted by filter. A nil filter accepts every event.
+// opts configure how the projection is reduced, e.g. WithRetryPolicy, but it's
+// always named after the projection.
+func (s *Store) RegisterProjection(name string, filter EventFilter, handler ProjectionHandler, opts ...ReducerOption) (*Projection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	root := namespace.Wrap(s.datastore, projectionsPrefix.ChildString(name))
+	p := &Projection{
+		name:       name,
+		filter:     filter,
+		handler:    handler,
+		eventcodec: s.eventcodec,
+		root:       root,
+		data:       namespace.Wrap(root, ds.NewKey("/data")),
+		instances:  namespace.Wrap(root, ds.NewKey("/instances")),
+		dispatcher: s.dispatcher,
+		store:      s,
+	}
+	opts = append(opts, WithReducerName(p.reducerName()))
+	if err := s.dispatcher.Register(p, opts...); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// Name returns the name of the projection.
+func (p *Projection) Name() string {
+	return p.name
+}
+
+// Datastore returns the datastore holding the projection state.
+func (p *Projection) Datastore() ds.Datastore {
+	return p.data
+}
+
+// Rebuild removes the projection state and reduces again every event in the log.
+func (p *Projection) Rebuild() error {
+	return p.dispatcher.replay(p.reducerName(), func() error {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		res, err := p.root.Query(query.Query{KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := p.root.Delete(ds.RawKey(e.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reduce decodes the action of event and applies it with the handler. The
+// projection copy of the instance and the handler writes are only
+// committed if the handler succeeds, so failed events can be reduced again.
+func (p *Projection) Reduce(event core.Event) error {
+	if p.filter != nil && !p.filter(event) {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Instances are tracked in the projection namespace to know the
+	// values before and after the event, whatever the model state is.
+	entityType, reduce := event.Type(), p.eventcodec.Reduce
+	if m := p.store.modelFor(event.Type()); m != nil {
+		// Events are reduced as their model does, so domain events are
+		// applied to its instances, and concurrent updates resolved
+		entityType, reduce = m.schema.Ref, m.reduceTo
+	}
+	baseKey := ds.NewKey(entityType)
+	key := baseKey.ChildString(event.EntityID().String())
+	// The instance and the handler writes are committed together, so a
+	// failed handler doesn't leave part of its writes behind
+	root := NewSimpleTx(p.root)
+	defer root.Discard()
+	txn := NewSimpleTx(namespace.Wrap(txnDatastore{root}, ds.NewKey("/instances")))
+	defer txn.Discard()
+	prev, err := getInstance(txn, key)
+	if err != nil {
+		return err
+	}
+	if err := reduce(event, txn, baseKey); err != nil {
+		return err
+	}
+	curr, err := getInstance(txn, key)
+	if err != nil {
+		return err
+	}
+
+	a := core.Action{
+		EntityID:   event.EntityID(),
+		EntityType: entityType,
+		Metadata:   event.Metadata(),
+	}
+	switch {
+	case bytes.Equal(prev, curr):
+		// Events already seen, or which don't change the instance
+		return commitProjection(txn, root)
+	case prev == nil:
+		a.Type = core.Create
+	case curr == nil:
+		a.Type = core.Delete
+	default:
+		a.Type = core.Save
+	}
+	if prev != nil {
+		a.Previous = prev
+	}
+	if curr != nil {
+		a.Current = curr
+	}
+	data := namespace.Wrap(txnDatastore{root}, ds.NewKey("/data"))
+	if err := p.handler(data, a); err != nil {
+		return fmt.Errorf("projection %s failed: %v", p.name, err)
+	}
+	return commitProjection(txn, root)
+}
+
+// commitProjection commits the instances txn into the root txn, and the
+// root txn into the projection datastore.
+func commitProjection(instances, root ds.Txn) error {
+	if err := instances.Commit(); err != nil {
+		return err
+	}
+	return root.Commit()
+}
+
+// txnDatastore exposes a transaction as a datastore, so it can be
+// namespaced. Closing it doesn't close the transaction.
+type txnDatastore struct {
+	ds.Txn
+}
+
+func (txnDatastore) Close() error {
+	return nil
+}
+
+func getInstance(r ds.Read, key ds.Key) (json.RawMessage, error) {
+	v, err := r.Get(key)
+	if err == ds.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(v), nil
+}
+
+func (p *Projection) reducerName() string {
+	return "projection/" + p.name
+}
+
+var _ Reducer = (*Projection)(nil)
@@ -0,0 +1,216 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestProjection(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	m, err := store.Register("Book", &book{})
+	checkErr(t, err)
+	pm, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+	p, err := store.RegisterProjection("authors", ByModel(m), countAuthors)
+	checkErr(t, err)
+
+	b1 := &book{Title: "Title1", Author: "Author1"}
+	b2 := &book{Title: "Title2", Author: "Author1"}
+	b3 := &book{Title: "Title3", Author: "Author2"}
+	checkErr(t, m.Create(b1, b2, b3))
+	b2.Author = "Author2"
+	checkErr(t, m.Save(b2))
+	checkErr(t, m.Delete(b3.ID))
+	checkErr(t, pm.Create(&Person{Name: "Foo"}))
+
+	expected := map[string]int{"Author1": 1, "Author2": 1}
+	assertAuthorCounts(t, p, expected)
+
+	t.Run("CatchUp", func(t *testing.T) {
+		late, err := store.RegisterProjection("late", ByModel(m), countAuthors)
+		checkErr(t, err)
+		assertAuthorCounts(t, late, expected)
+	})
+	t.Run("Rebuild", func(t *testing.T) {
+		checkErr(t, p.Datastore().Put(ds.NewKey("Author1"), []byte("42")))
+		checkErr(t, p.Datastore().Put(ds.NewKey("Author3"), []byte("1")))
+		checkErr(t, p.Rebuild())
+		assertAuthorCounts(t, p, expected)
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		unregistered := &Projection{name: "unknown", dispatcher: store.dispatcher}
+		if err := unregistered.Rebuild(); err != ErrUnknownReducer {
+			t.Fatalf("expected unknown reducer error, got: %v", err)
+		}
+	})
+}
+
+// countAuthors keeps the number of books of each author.
+func countAuthors(store ds.Datastore, a core.Action) error {
+	for _, v := range []struct {
+		value interface{}
+		delta int
+	}{{a.Previous, -1}, {a.Current, 1}} {
+		if v.value == nil {
+			continue
+		}
+		var b book
+		if err := json.Unmarshal(v.value.(json.RawMessage), &b); err != nil {
+			return err
+		}
+		key := ds.NewKey(b.Author)
+		count := 0
+		c, err := store.Get(key)
+		if err != nil && err != ds.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			if count, err = strconv.Atoi(string(c)); err != nil {
+				return err
+			}
+		}
+		if count += v.delta; count == 0 {
+			err = store.Delete(key)
+		} else {
+			err = store.Put(key, []byte(strconv.Itoa(count)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func assertAuthorCounts(t *testing.T, p *Projection, expected map[string]int) {
+	t.Helper()
+	res, err := p.Datastore().Query(query.Query{})
+	checkErr(t, err)
+	entries, err := res.Rest()
+	checkErr(t, err)
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d authors, got %d", len(expected), len(entries))
+	}
+	for author, count := range expected {
+		c, err := p.Datastore().Get(ds.NewKey(author))
+		checkErr(t, err)
+		if string(c) != strconv.Itoa(count) {
+			t.Fatalf("expected %d books of %s, got %s", count, author, c)
+		}
+	}
+}
+
+func TestProjectionFailedHandler(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	m, err := store.Register("Book", &book{})
+	checkErr(t, err)
+	failures := 1
+	p, err := store.RegisterProjection("authors", ByModel(m), func(store ds.Datastore, a core.Action) error {
+		if failures > 0 {
+			failures--
+			return errFlaky
+		}
+		return countAuthors(store, a)
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	checkErr(t, err)
+
+	// The failed create is retried as a create
+	checkErr(t, m.Create(&book{Title: "Title1", Author: "Author1"}))
+	checkErr(t, store.dispatcher.WaitFor(context.Background(), 1))
+	assertAuthorCounts(t, p, map[string]int{"Author1": 1})
+	if letters, err := store.dispatcher.DeadLetters(""); err != nil || len(letters) != 0 {
+		t.Fatalf("retried event shouldn't be dead lettered, got %v: %v", letters, err)
+	}
+}
+
+func TestProjectionPartialHandler(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	m, err := store.Register("Book", &book{})
+	checkErr(t, err)
+	failures := 1
+	p, err := store.RegisterProjection("authors", ByModel(m), func(store ds.Datastore, a core.Action) error {
+		// The handler fails after writing, so its writes are discarded
+		if err := countAuthors(store, a); err != nil {
+			return err
+		}
+		if failures > 0 {
+			failures--
+			return errFlaky
+		}
+		return nil
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	checkErr(t, err)
+
+	checkErr(t, m.Create(&book{Title: "Title1", Author: "Author1"}))
+	checkErr(t, store.dispatcher.WaitFor(context.Background(), 1))
+	assertAuthorCounts(t, p, map[string]int{"Author1": 1})
+}
+
+func TestProjectionRetryDoesntBlockWriters(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	m, err := store.Register("Book", &book{})
+	checkErr(t, err)
+	_, err = store.RegisterProjection("failing", ByModel(m), func(ds.Datastore, core.Action) error {
+		return errFlaky
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 4, Backoff: 300 * time.Millisecond}))
+	checkErr(t, err)
+
+	checkErr(t, m.Create(&book{Title: "Title1", Author: "Author1"}))
+	// The projection is still retrying the first event, which doesn't
+	// block writes to the model
+	checkErr(t, m.Create(&book{Title: "Title2", Author: "Author2"}))
+	if !store.dispatcher.retrying(1) {
+		t.Fatal("write waited for the projection retries")
+	}
+	checkErr(t, store.dispatcher.WaitFor(context.Background(), 2))
+}
+
+func TestProjectionConflicts(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := peers{}
+	a, b := createTestStore(WithReplicaID("a")), createTestStore(WithReplicaID("b"))
+	rb := NewReplicator(b, transport)
+	transport["a"] = NewReplicator(a, transport)
+	ma, err := a.Register("Person", &Person{}, WithConflictResolver(LastWriterWins))
+	checkErr(t, err)
+	mb, err := b.Register("Person", &Person{}, WithConflictResolver(LastWriterWins))
+	checkErr(t, err)
+	p, err := b.RegisterProjection("people", ByModel(mb), func(store ds.Datastore, a core.Action) error {
+		key := ds.NewKey(a.EntityID.String())
+		if a.Current == nil {
+			return store.Delete(key)
+		}
+		return store.Put(key, a.Current.(json.RawMessage))
+	})
+	checkErr(t, err)
+
+	person := &Person{Name: "Foo", Age: 42}
+	checkErr(t, ma.Create(person))
+	checkErr(t, rb.Sync(ctx, "a"))
+	pa, pb := *person, *person
+	pa.Name, pb.Name, pb.Age = "A", "B", 50
+	checkErr(t, ma.Save(&pa))
+	checkErr(t, mb.Save(&pb))
+	checkErr(t, rb.Sync(ctx, "a"))
+
+	// The projection resolves the concurrent changes as the model does
+	var projected, reduced Person
+	v, err := p.Datastore().Get(ds.NewKey(person.ID.String()))
+	checkErr(t, err)
+	checkErr(t, json.Unmarshal(v, &projected))
+	checkErr(t, mb.FindByID(person.ID, &reduced))
+	if projected != reduced || reduced.Name != "B" || reduced.Age != 50 {
+		t.Fatalf("projection should converge with the model, got %+v and %+v", projected, reduced)
+	}
+}
@@ -0,0 +1,215 @@
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+const (
+	// replicationBatchSize is the maximum number of records exchanged at once
+	replicationBatchSize = 100
+)
+
+var (
+	replicationPrefix = datastore.NewKey("/replication")
+
+	// ErrUnknownPeer indicates there's no peer at the given address
+	ErrUnknownPeer = errors.New("unknown peer")
+)
+
+// LogHead describes the last record of an event log.
+type LogHead struct {
+	// Seq is the sequence of the last record, zero if the log is empty
+	Seq uint64
+	// CID is the binary CID of the last record, nil if the log is empty
+	CID []byte
+}
+
+// Peer is a node exchanging its event log with others.
+type Peer interface {
+	// Head returns the head of the peer log.
+	Head(ctx context.Context) (LogHead, error)
+	// Records returns up to limit encoded records of the peer log after the given sequence.
+	Records(ctx context.Context, after uint64, limit int) ([][]byte, error)
+	// Push sends encoded records to the peer, which dispatches the events it's missing.
+	Push(ctx context.Context, records [][]byte) error
+}
+
+// Transport connects to remote peers. Peers it returns are closed after
+// use if they implement io.Closer.
+type Transport interface {
+	Dial(ctx context.Context, addr string) (Peer, error)
+}
+
+// Replicator exchanges the events of a Store with remote peers. It keeps,
+// for each peer, how far its log was pulled and how far the local log was
+// pushed to it, so only new records are exchanged. Received events missing
+// locally are dispatched to the Store, so they're verified and reduced as
+// any other event, while duplicates are skipped.
+type Replicator struct {
+	store     *Store
+	transport Transport
+}
+
+var _ Peer = (*Replicator)(nil)
+
+// NewReplicator returns a Replicator for store connecting to peers with transport.
+func NewReplicator(store *Store, transport Transport) *Replicator {
+	return &Replicator{store: store, transport: transport}
+}
+
+// Head returns the head of the local event log.
+func (r *Replicator) Head(ctx context.Context) (LogHead, error) {
+	d := r.store.dispatcher
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.loadHead(); err != nil {
+		return LogHead{}, err
+	}
+	return LogHead{Seq: d.seq, CID: append([]byte(nil), d.head...)}, nil
+}
+
+// Records returns up to limit encoded records of the local event log after the given sequence.
+func (r *Replicator) Records(ctx context.Context, after uint64, limit int) ([][]byte, error) {
+	d := r.store.dispatcher
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var records [][]byte
+	err := d.scan(ctx, after+1, func(_ uint64, _ datastore.Key, b []byte) (bool, error) {
+		records = append(records, b)
+		return len(records) < limit, nil
+	})
+	return records, err
+}
+
+// Push dispatches the events of records, skipping the ones already in the local event log.
+func (r *Replicator) Push(ctx context.Context, records [][]byte) error {
+	events := make([]core.Event, len(records))
+	for i := range records {
+		rec, _, err := decodeRecord(records[i])
+		if err != nil {
+			return err
+		}
+		events[i] = &rec.Event
+	}
+	_, err := r.store.DispatchBatch(events)
+	return err
+}
+
+// Sync exchanges events with the peer at addr, in both directions. Once
+// done, and if no other events were dispatched meanwhile, both logs hold
+// the same events. Events dispatched concurrently in both nodes end up in
+// a different order in each log, otherwise logs are identical.
+func (r *Replicator) Sync(ctx context.Context, addr string) error {
+	peer, err := r.transport.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if c, ok := peer.(io.Closer); ok {
+		defer c.Close()
+	}
+	local, err := r.Head(ctx)
+	if err != nil {
+		return err
+	}
+	remote, err := peer.Head(ctx)
+	if err != nil {
+		return err
+	}
+	if local.Seq == remote.Seq && bytes.Equal(local.CID, remote.CID) {
+		// Same head means same log, so there's nothing to exchange
+		if err := r.saveCursor(replicationKey(addr, "pulled"), remote.Seq); err != nil {
+			return err
+		}
+		return r.saveCursor(replicationKey(addr, "pushed"), local.Seq)
+	}
+	if err := r.pull(ctx, addr, peer, remote); err != nil {
+		return err
+	}
+	return r.push(ctx, addr, peer)
+}
+
+// pull dispatches the events of the peer log after the last pulled one.
+func (r *Replicator) pull(ctx context.Context, addr string, peer Peer, remote LogHead) error {
+	key := replicationKey(addr, "pulled")
+	cursor, err := r.loadCursor(key)
+	if err != nil {
+		return err
+	}
+	if cursor > remote.Seq {
+		// The peer log was reset, so everything is pulled again
+		cursor = 0
+	}
+	for cursor < remote.Seq {
+		records, err := peer.Records(ctx, cursor, replicationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		if err := r.Push(ctx, records); err != nil {
+			return err
+		}
+		cursor += uint64(len(records))
+		if err := r.saveCursor(key, cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push sends to the peer the records of the local log after the last pushed
+// one, acknowledging them in the peer SyncQueue.
+func (r *Replicator) push(ctx context.Context, addr string, peer Peer) error {
+	key := replicationKey(addr, "pushed")
+	cursor, err := r.loadCursor(key)
+	if err != nil {
+		return err
+	}
+	for {
+		records, err := r.Records(ctx, cursor, replicationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		if err := peer.Push(ctx, records); err != nil {
+			return err
+		}
+		cursor += uint64(len(records))
+		if err := r.saveCursor(key, cursor); err != nil {
+			return err
+		}
+		if err := r.store.SyncQueue(addr).AckUpTo(cursor); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Replicator) loadCursor(key datastore.Key) (uint64, error) {
+	b, err := r.store.dispatcher.store.Get(key)
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+func (r *Replicator) saveCursor(key datastore.Key, cursor uint64) error {
+	return r.store.dispatcher.store.Put(key, []byte(strconv.FormatUint(cursor, 10)))
+}
+
+func replicationKey(addr, cursor string) datastore.Key {
+	return replicationPrefix.ChildString(url.PathEscape(addr)).ChildString(cursor)
+}
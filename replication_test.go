@@ -0,0 +1,96 @@
+package eventstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := peers{}
+	a, b := createTestStore(), createTestStore()
+	ra, rb := NewReplicator(a, transport), NewReplicator(b, transport)
+	transport["a"], transport["b"] = ra, rb
+	ma, err := a.Register("Person", &Person{})
+	checkErr(t, err)
+	mb, err := b.Register("Person", &Person{})
+	checkErr(t, err)
+
+	p1, p2 := &Person{Name: "Foo", Age: 42}, &Person{Name: "Bar", Age: 43}
+	checkErr(t, ma.Create(p1, p2))
+	checkErr(t, rb.Sync(ctx, "a"))
+	assertReplicated(t, ra, rb)
+	assertPersonInModel(t, mb, p1)
+	assertPersonInModel(t, mb, p2)
+
+	p3 := &Person{Name: "Baz", Age: 44}
+	checkErr(t, mb.Create(p3))
+	p1.Age = 50
+	checkErr(t, mb.Save(p1))
+	checkErr(t, rb.Sync(ctx, "a"))
+	assertReplicated(t, ra, rb)
+	assertPersonInModel(t, ma, p1)
+	assertPersonInModel(t, ma, p3)
+
+	t.Run("Cursors", func(t *testing.T) {
+		counter := &countingPeer{Peer: ra}
+		transport["counter"] = counter
+		checkErr(t, rb.Sync(ctx, "counter"))
+		checkErr(t, ma.Delete(p2.ID))
+		counter.records, counter.pushed = nil, 0
+		checkErr(t, rb.Sync(ctx, "counter"))
+		if !reflect.DeepEqual(counter.records, []int{1}) || counter.pushed != 1 {
+			t.Fatalf("only the new event should be exchanged, got %v records pulled and %d pushed", counter.records, counter.pushed)
+		}
+		assertReplicated(t, ra, rb)
+	})
+	t.Run("UnknownPeer", func(t *testing.T) {
+		if err := rb.Sync(ctx, "unknown"); err != ErrUnknownPeer {
+			t.Fatalf("expected unknown peer error, got: %v", err)
+		}
+	})
+}
+
+// peers is a Transport of in-process peers.
+type peers map[string]Peer
+
+func (p peers) Dial(_ context.Context, addr string) (Peer, error) {
+	peer, ok := p[addr]
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	return peer, nil
+}
+
+// countingPeer counts the records exchanged with a Peer.
+type countingPeer struct {
+	Peer
+	records []int
+	pushed  int
+}
+
+func (p *countingPeer) Records(ctx context.Context, after uint64, limit int) ([][]byte, error) {
+	records, err := p.Peer.Records(ctx, after, limit)
+	if len(records) > 0 {
+		p.records = append(p.records, len(records))
+	}
+	return records, err
+}
+
+func (p *countingPeer) Push(ctx context.Context, records [][]byte) error {
+	p.pushed += len(records)
+	return p.Peer.Push(ctx, records)
+}
+
+func assertReplicated(t *testing.T, a, b *Replicator) {
+	t.Helper()
+	ha, err := a.Head(context.Background())
+	checkErr(t, err)
+	hb, err := b.Head(context.Background())
+	checkErr(t, err)
+	if !reflect.DeepEqual(ha, hb) {
+		t.Fatalf("logs should be identical, got heads %v and %v", ha, hb)
+	}
+}
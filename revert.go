@@ -0,0 +1,102 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	errUndoOtherModel = errors.New("can't undo event of another model")
+)
+
+// Revert commits a compensating event undoing the event with eventID.
+func (m *Model) Revert(eventID string) error {
+	return m.WriteTxn(func(txn *Txn) error {
+		return txn.Undo(eventID)
+	})
+}
+
+// Undo adds to the transaction the compensating action of the event with
+// eventID, which restores what the event changed over the committed
+// instance: created instances are deleted, deleted ones created again,
+// and saved fields get their previous values back. The codec must
+// implement core.Reverter, and domain events can't be undone.
+func (t *Txn) Undo(eventID string) error {
+	if t.readonly {
+		return ErrReadonlyTx
+	}
+	entry, err := t.model.dispatcher.EventByID(eventID)
+	if err != nil {
+		return err
+	}
+	event := entry.Event
+	if event.Type() != t.model.schema.Ref {
+		if t.model.handles(event.Type()) {
+			return fmt.Errorf("%w: %s is a domain event", core.ErrNotRevertible, eventID)
+		}
+		return errUndoOtherModel
+	}
+	reverter, ok := t.model.eventcodec.(core.Reverter)
+	if !ok {
+		return core.ErrNotRevertible
+	}
+
+	key := t.model.dsKey.ChildString(event.EntityID().String())
+	current, err := t.model.datastore.Get(key)
+	if err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	reverted, err := reverter.Revert(event, current)
+	if err != nil {
+		return err
+	}
+
+	a := core.Action{
+		EntityID:   event.EntityID(),
+		EntityType: t.model.schema.Ref,
+		Metadata:   core.Metadata{CausationID: eventID},
+	}
+	switch {
+	case current == nil && reverted == nil:
+		return nil
+	case reverted == nil:
+		a.Type = core.Delete
+	case current == nil:
+		a.Type = core.Create
+	default:
+		a.Type = core.Save
+	}
+	if current != nil {
+		if a.Previous, err = t.model.decodeInstance(current); err != nil {
+			return err
+		}
+	}
+	if reverted != nil {
+		if a.Current, err = t.model.decodeInstance(reverted); err != nil {
+			return err
+		}
+		valid, err := t.model.validInstance(a.Current)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return ErrInvalidSchemaInstance
+		}
+	}
+	t.actions = append(t.actions, a)
+	return nil
+}
+
+// decodeInstance returns a new instance of the model decoded from b.
+func (m *Model) decodeInstance(b []byte) (interface{}, error) {
+	v := reflect.New(m.valueType.Elem()).Interface()
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
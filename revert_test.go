@@ -0,0 +1,78 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestRevert(t *testing.T) {
+	t.Parallel()
+	s := createTestStore()
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+	p.Age = 43
+	checkErr(t, m.Save(p))
+	p.Name = "Bar"
+	checkErr(t, m.Save(p))
+	events := modelEvents(t, s, m)
+
+	// Fields changed after the reverted event are kept
+	checkErr(t, m.Revert(events[1].Metadata().EventID))
+	assertPersonInModel(t, m, &Person{ID: p.ID, Name: "Bar", Age: 42})
+	events = modelEvents(t, s, m)
+	if cause := events[3].Metadata().CausationID; cause != events[1].Metadata().EventID {
+		t.Fatalf("compensating event should be caused by the reverted one, got %q", cause)
+	}
+
+	t.Run("Delete", func(t *testing.T) {
+		checkErr(t, m.Delete(p.ID))
+		events := modelEvents(t, s, m)
+		checkErr(t, m.Revert(events[len(events)-1].Metadata().EventID))
+		assertPersonInModel(t, m, &Person{ID: p.ID, Name: "Bar", Age: 42})
+	})
+	t.Run("Create", func(t *testing.T) {
+		checkErr(t, m.Revert(events[0].Metadata().EventID))
+		if exists, err := m.Has(p.ID); err != nil || exists {
+			t.Fatalf("created instance should be deleted, got: %v %v", exists, err)
+		}
+		// Saves of deleted instances can't be reverted
+		if err := m.Revert(events[2].Metadata().EventID); err == nil {
+			t.Fatal("reverting a save of a deleted instance should fail")
+		}
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		if err := m.Revert(core.NewEventID()); err != ErrEventNotFound {
+			t.Fatalf("expected event not found error, got: %v", err)
+		}
+	})
+	t.Run("DomainEvent", func(t *testing.T) {
+		lm := registerLoans(t, s)
+		b := &loanedBook{Title: "Title1"}
+		checkErr(t, lm.Create(b))
+		checkErr(t, lm.Execute(b.ID, borrowBook{UserID: "alice"}))
+		events := modelEvents(t, s, lm)
+		if err := lm.Revert(events[1].Metadata().EventID); !errors.Is(err, core.ErrNotRevertible) {
+			t.Fatalf("expected not revertible error, got: %v", err)
+		}
+		if err := m.Revert(events[0].Metadata().EventID); err != errUndoOtherModel {
+			t.Fatalf("expected other model error, got: %v", err)
+		}
+	})
+}
+
+func modelEvents(t *testing.T, s *Store, m *Model) []core.Event {
+	t.Helper()
+	entries, err := s.dispatcher.Events(context.Background(), 0, 0, ByModel(m))
+	checkErr(t, err)
+	events := make([]core.Event, len(entries))
+	for i := range entries {
+		events[i] = entries[i].Event
+	}
+	return events
+}
@@ -0,0 +1,141 @@
+package eventstore
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+)
+
+var (
+	sagasPrefix = ds.NewKey("/sagas")
+)
+
+// SagaHandler reacts to an event committed in the log, typically issuing new
+// transactions against store. The saga can persist its own state in state.
+// Handlers are invoked at least once for each event, so they should be idempotent.
+type SagaHandler func(store *Store, state ds.Datastore, entry LogEntry) error
+
+// Saga is a process manager following the event log. Every event accepted
+// by its filter is handled after it's reduced, in log order. Progress is
+// checkpointed, so a saga registered again with the same name resumes
+// after the last event it handled.
+type Saga struct {
+	name    string
+	filter  EventFilter
+	handler SagaHandler
+	store   *Store
+	state   ds.Datastore
+	reg     *registration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// RegisterSaga starts a saga named name, whose handler is invoked with every
+// event accepted by filter. A nil filter accepts every event. Failed events are
+// retried until they succeed, or stored as dead letters of the saga after all the
+// attempts of a RetryPolicy given with WithRetryPolicy. Dead letters of sagas can
+// be listed and discarded, but not retried, through the Dispatcher.
+func (s *Store) RegisterSaga(name string, filter EventFilter, handler SagaHandler, opts ...ReducerOption) (*Saga, error) {
+	reg := &registration{name: "saga/" + name}
+	for _, opt := range opts {
+		opt(reg)
+	}
+	cp, err := s.dispatcher.loadCheckpoint(reg.name)
+	if err != nil {
+		return nil, err
+	}
+	reg.checkpoint = cp
+
+	ctx, cancel := context.WithCancel(context.Background())
+	saga := &Saga{
+		name:    name,
+		filter:  filter,
+		handler: handler,
+		store:   s,
+		state:   namespace.Wrap(s.datastore, sagasPrefix.ChildString(name)),
+		reg:     reg,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go saga.run()
+	return saga, nil
+}
+
+// Name returns the name of the saga.
+func (s *Saga) Name() string {
+	return s.name
+}
+
+// State returns the datastore holding the saga state.
+func (s *Saga) State() ds.Datastore {
+	return s.state
+}
+
+// Close stops the saga, waiting for the event being handled.
+func (s *Saga) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *Saga) run() {
+	defer close(s.done)
+	d := s.store.dispatcher
+	wake, stop := d.watch()
+	defer stop()
+	for {
+		if err := s.process(); err != nil && s.ctx.Err() == nil {
+			log.Errorf("error when running saga %s: %v", s.name, err)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-wake:
+		}
+	}
+}
+
+// process handles every persisted event after the saga checkpoint.
+func (s *Saga) process() error {
+	d := s.store.dispatcher
+	last, err := d.LastSeq()
+	if err != nil {
+		return err
+	}
+	if s.reg.checkpoint >= last {
+		return nil
+	}
+	entries, err := d.Events(s.ctx, s.reg.checkpoint+1, last, nil)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if s.filter != nil && !s.filter(e.Event) {
+			continue
+		}
+		if err := d.WaitFor(s.ctx, e.Seq); err != nil {
+			return err
+		}
+		if err := s.handle(e); err != nil {
+			return err
+		}
+		// Handled events are checkpointed right away, so they aren't
+		// handled again if the saga stops
+		if err := d.saveCheckpoint(s.reg, e.Seq); err != nil {
+			return err
+		}
+	}
+	return d.saveCheckpoint(s.reg, last)
+}
+
+// handle invokes the handler with e until it succeeds, the saga is
+// closed, or the attempts of its retry policy are exhausted.
+func (s *Saga) handle(e LogEntry) error {
+	return s.store.dispatcher.retry(s.ctx, s.reg.name, e.Seq, s.reg.policy, func() error {
+		return s.handler(s.store, s.state, e)
+	})
+}
@@ -0,0 +1,151 @@
+package eventstore
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+type review struct {
+	ID     core.EntityID
+	BookID string
+	Body   string
+}
+
+func TestSaga(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	books, err := store.Register("Book", &book{})
+	checkErr(t, err)
+	reviews, err := store.Register("Review", &review{})
+	checkErr(t, err)
+	handler := deleteReviews(books, reviews)
+	saga, err := store.RegisterSaga("reviews", ByModel(books), handler)
+	checkErr(t, err)
+
+	b1, b2 := &book{Title: "Title1"}, &book{Title: "Title2"}
+	checkErr(t, books.Create(b1, b2))
+	r1 := &review{BookID: b1.ID.String(), Body: "Good"}
+	r2 := &review{BookID: b1.ID.String(), Body: "Bad"}
+	r3 := &review{BookID: b2.ID.String(), Body: "Ok"}
+	checkErr(t, reviews.Create(r1, r2, r3))
+
+	checkErr(t, books.Delete(b1.ID))
+	waitFor(t, func() bool {
+		exists, err := reviews.Has(r1.ID, r2.ID)
+		checkErr(t, err)
+		return !exists
+	})
+	assertReviewsDeleted(t, saga, 2)
+
+	t.Run("Restart", func(t *testing.T) {
+		checkErr(t, saga.Close())
+		checkErr(t, books.Delete(b2.ID))
+		exists, err := reviews.Has(r3.ID)
+		checkErr(t, err)
+		if !exists {
+			t.Fatal("closed saga shouldn't handle events")
+		}
+
+		restarted, err := store.RegisterSaga("reviews", ByModel(books), handler)
+		checkErr(t, err)
+		defer restarted.Close()
+		waitFor(t, func() bool {
+			exists, err := reviews.Has(r3.ID)
+			checkErr(t, err)
+			return !exists
+		})
+		assertReviewsDeleted(t, restarted, 3)
+		seq, err := store.dispatcher.LastSeq()
+		checkErr(t, err)
+		waitFor(t, func() bool {
+			cp, err := store.dispatcher.Checkpoint("saga/reviews")
+			checkErr(t, err)
+			return cp == seq
+		})
+	})
+}
+
+func TestSagaDeadLetters(t *testing.T) {
+	t.Parallel()
+	store := createTestStore()
+	m, err := store.Register("Person", &Person{})
+	checkErr(t, err)
+	saga, err := store.RegisterSaga("failing", nil, func(*Store, ds.Datastore, LogEntry) error {
+		return errors.New("saga error")
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}))
+	checkErr(t, err)
+	defer saga.Close()
+
+	checkErr(t, m.Create(&Person{Name: "Foo"}))
+	var letters []DeadLetter
+	waitFor(t, func() bool {
+		letters, err = store.dispatcher.DeadLetters("saga/failing")
+		checkErr(t, err)
+		return len(letters) == 1
+	})
+	if letters[0].Seq != 1 || letters[0].Attempts != 2 {
+		t.Fatalf("unexpected dead letter: %+v", letters[0])
+	}
+}
+
+// deleteReviews deletes the reviews of deleted books, counting them in the saga state.
+func deleteReviews(books, reviews *Model) SagaHandler {
+	return func(store *Store, state ds.Datastore, e LogEntry) error {
+		exists, err := books.Has(e.Event.EntityID())
+		if err != nil || exists {
+			return err
+		}
+		var res []*review
+		if err := reviews.Find(&res, Where("BookID").Eq(e.Event.EntityID().String())); err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return nil
+		}
+		ids := make([]core.EntityID, len(res))
+		for i := range res {
+			ids[i] = res[i].ID
+		}
+		if err := reviews.Delete(ids...); err != nil {
+			return err
+		}
+		var count int
+		v, err := state.Get(ds.NewKey("deleted"))
+		if err == nil {
+			if count, err = strconv.Atoi(string(v)); err != nil {
+				return err
+			}
+		} else if err != ds.ErrNotFound {
+			return err
+		}
+		return state.Put(ds.NewKey("deleted"), []byte(strconv.Itoa(count+len(ids))))
+	}
+}
+
+func assertReviewsDeleted(t *testing.T, saga *Saga, count int) {
+	t.Helper()
+	waitFor(t, func() bool {
+		v, err := saga.State().Get(ds.NewKey("deleted"))
+		if err == ds.ErrNotFound {
+			return false
+		}
+		checkErr(t, err)
+		return string(v) == strconv.Itoa(count)
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,113 @@
+// Package signature provides Ed25519 implementations of core.Signer and core.Verifier.
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	// ErrUntrustedKey indicates the event was signed by a key which isn't trusted
+	ErrUntrustedKey = errors.New("event signed by untrusted key")
+	// ErrInvalidKey indicates the public key isn't a valid Ed25519 key
+	ErrInvalidKey = errors.New("invalid ed25519 public key")
+	// ErrOriginMismatch indicates the event was signed by a trusted key
+	// which isn't the one of the replica the event originates from
+	ErrOriginMismatch = errors.New("event signed by a key of another origin")
+)
+
+type ed25519Signer struct {
+	priv ed25519.PrivateKey
+}
+
+var _ core.Signer = (*ed25519Signer)(nil)
+
+// NewEd25519Signer returns a core.Signer which signs with priv.
+func NewEd25519Signer(priv ed25519.PrivateKey) core.Signer {
+	return &ed25519Signer{priv: priv}
+}
+
+// GenerateEd25519Signer returns a core.Signer with a freshly generated key.
+func GenerateEd25519Signer() (core.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewEd25519Signer(priv), nil
+}
+
+func (s *ed25519Signer) PublicKey() []byte {
+	return s.priv.Public().(ed25519.PublicKey)
+}
+
+func (s *ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.priv, data), nil
+}
+
+type ed25519Verifier struct {
+	trusted []ed25519.PublicKey
+	origins map[string]ed25519.PublicKey
+}
+
+var _ core.OriginVerifier = (*ed25519Verifier)(nil)
+
+// NewEd25519Verifier returns a core.Verifier for Ed25519 signatures by
+// the trusted keys. Signatures by any other key are rejected, so without
+// trusted keys every event is rejected.
+func NewEd25519Verifier(trusted ...ed25519.PublicKey) core.Verifier {
+	return &ed25519Verifier{trusted: trusted}
+}
+
+// NewEd25519OriginVerifier returns a core.Verifier for Ed25519 signatures
+// binding each replica ID to its key. Events must be signed by the key of
+// the replica they originate from, so a trusted peer can't sign events as
+// if they were created by another one.
+func NewEd25519OriginVerifier(keys map[string]ed25519.PublicKey) core.Verifier {
+	v := &ed25519Verifier{origins: make(map[string]ed25519.PublicKey, len(keys))}
+	for origin, k := range keys {
+		v.trusted = append(v.trusted, k)
+		v.origins[origin] = k
+	}
+	return v
+}
+
+func (v *ed25519Verifier) Verify(pubKey []byte, data []byte, sig []byte) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return ErrInvalidKey
+	}
+	if !v.isTrusted(pubKey) {
+		return ErrUntrustedKey
+	}
+	if !ed25519.Verify(pubKey, data, sig) {
+		return core.ErrInvalidSignature
+	}
+	return nil
+}
+
+func (v *ed25519Verifier) VerifyOrigin(origin string, pubKey []byte) error {
+	if v.origins == nil {
+		return nil
+	}
+	k, ok := v.origins[origin]
+	if !ok {
+		return fmt.Errorf("%w: unknown origin %q", ErrUntrustedKey, origin)
+	}
+	if !bytes.Equal(k, pubKey) {
+		return fmt.Errorf("%w: %q", ErrOriginMismatch, origin)
+	}
+	return nil
+}
+
+func (v *ed25519Verifier) isTrusted(pubKey []byte) bool {
+	for _, k := range v.trusted {
+		if bytes.Equal(k, pubKey) {
+			return true
+		}
+	}
+	return false
+}
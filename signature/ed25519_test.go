@@ -0,0 +1,112 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestSignVerify(t *testing.T) {
+	signer, err := GenerateEd25519Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := core.SignEvent(core.NewNullEvent(time.Now()), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := NewEd25519Verifier(ed25519.PublicKey(signer.PublicKey()))
+	t.Run("Trusted", func(t *testing.T) {
+		if err := core.VerifyEvent(e, trusted); err != nil {
+			t.Fatalf("signature should be valid: %v", err)
+		}
+	})
+	t.Run("NoTrustedKeys", func(t *testing.T) {
+		if err := core.VerifyEvent(e, NewEd25519Verifier()); !errors.Is(err, ErrUntrustedKey) {
+			t.Fatalf("signature should be rejected without trusted keys, got: %v", err)
+		}
+	})
+	t.Run("Untrusted", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := core.VerifyEvent(e, NewEd25519Verifier(other)); !errors.Is(err, ErrUntrustedKey) {
+			t.Fatalf("signature from untrusted key should be rejected, got: %v", err)
+		}
+	})
+	t.Run("Unsigned", func(t *testing.T) {
+		err := core.VerifyEvent(core.NewNullEvent(time.Now()), NewEd25519Verifier())
+		if !errors.Is(err, core.ErrUnsignedEvent) {
+			t.Fatalf("unsigned event should be rejected, got: %v", err)
+		}
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		other, err := core.SignEvent(core.NewNullEvent(time.Now().Add(time.Hour)), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := core.SigningBytes(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = trusted.Verify(e.PublicKey(), data, e.Signature())
+		if !errors.Is(err, core.ErrInvalidSignature) {
+			t.Fatalf("tampered event should be rejected, got: %v", err)
+		}
+	})
+}
+
+func TestOriginVerifier(t *testing.T) {
+	a, err := GenerateEd25519Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateEd25519Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewEd25519OriginVerifier(map[string]ed25519.PublicKey{
+		"a": a.PublicKey(),
+		"b": b.PublicKey(),
+	})
+	tests := []struct {
+		name     string
+		origin   string
+		signer   core.Signer
+		expected error
+	}{
+		{"Valid", "a", a, nil},
+		{"OtherOrigin", "b", a, ErrOriginMismatch},
+		{"UnknownOrigin", "c", a, ErrUntrustedKey},
+		{"NoOrigin", "", b, ErrUntrustedKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &originEvent{Event: core.NewNullEvent(time.Now()), origin: tt.origin}
+			se, err := core.SignEvent(e, tt.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := core.VerifyEvent(se, v); !errors.Is(err, tt.expected) {
+				t.Fatalf("expected error %v, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+type originEvent struct {
+	core.Event
+	origin string
+}
+
+func (e *originEvent) Metadata() core.Metadata {
+	md := e.Event.Metadata()
+	md.Origin = e.origin
+	return md
+}
@@ -0,0 +1,30 @@
+// Package sink provides eventstore.Sink implementations to publish
+// events with an eventstore.Outbox.
+package sink
+
+import (
+	"context"
+
+	es "github.com/textileio/go-eventstore"
+)
+
+type channelSink struct {
+	ch chan<- es.LogEntry
+}
+
+var _ es.Sink = (*channelSink)(nil)
+
+// NewChannel returns an in-process es.Sink which sends events to ch. Sending
+// blocks until the event is received.
+func NewChannel(ch chan<- es.LogEntry) es.Sink {
+	return &channelSink{ch: ch}
+}
+
+func (s *channelSink) Send(ctx context.Context, entry es.LogEntry) error {
+	select {
+	case s.ch <- entry:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
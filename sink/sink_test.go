@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	es "github.com/textileio/go-eventstore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestChannel(t *testing.T) {
+	t.Parallel()
+	dispatcher := es.NewDispatcher(es.NewTxMapDatastore())
+	ch := make(chan es.LogEntry)
+	outbox, err := dispatcher.StartOutbox("channel", nil, NewChannel(ch))
+	checkErr(t, err)
+	defer outbox.Close()
+
+	checkErr(t, dispatcher.Dispatch(core.NewNullEvent(time.Now())))
+	select {
+	case e := <-ch:
+		if e.Seq != 1 {
+			t.Fatalf("expected event 1, got %d", e.Seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event should be sent to the channel")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+	var lock sync.Mutex
+	var requests int
+	received := make(chan WebhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		fail := requests == 1
+		lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("invalid payload: %v", err)
+		}
+		if r.Header.Get(IdempotencyKeyHeader) != p.ID || p.ID == "" {
+			t.Errorf("idempotency key should be the event ID")
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	dispatcher := es.NewDispatcher(es.NewTxMapDatastore())
+	outbox, err := dispatcher.StartOutbox("webhook", nil, NewWebhook(server.URL, nil),
+		es.WithRetryPolicy(es.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	checkErr(t, err)
+	defer outbox.Close()
+
+	event := core.NewNullEvent(time.Now())
+	checkErr(t, dispatcher.Dispatch(event))
+	select {
+	case p := <-received:
+		if p.Seq != 1 || p.EntityID != event.EntityID().String() || p.Type != event.Type() {
+			t.Fatalf("unexpected payload: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event should be posted to the webhook")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	entry := es.LogEntry{Seq: 1, Event: core.NewNullEvent(time.Now())}
+	if err := NewWebhook(server.URL, nil).Send(context.Background(), entry); err == nil {
+		t.Fatal("non 2xx responses should fail")
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
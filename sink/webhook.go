@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	es "github.com/textileio/go-eventstore"
+	"github.com/textileio/go-eventstore/core"
+)
+
+const (
+	// IdempotencyKeyHeader holds the ID of the event in webhook requests,
+	// which receivers should use to ignore events delivered more than once
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// WebhookPayload is the JSON body of webhook requests. ID is the
+// URL-safe base64 encoding of the event key.
+type WebhookPayload struct {
+	Seq      uint64        `json:"seq"`
+	ID       string        `json:"id"`
+	Time     []byte        `json:"time"`
+	EntityID string        `json:"entityID"`
+	Type     string        `json:"type"`
+	Body     []byte        `json:"body"`
+	Metadata core.Metadata `json:"metadata"`
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+var _ es.Sink = (*webhookSink)(nil)
+
+// NewWebhook returns an es.Sink which POSTs events to url as JSON encoded
+// WebhookPayloads. Any response status other than 2xx is a failed delivery.
+// If client is nil, http.DefaultClient is used.
+func NewWebhook(url string, client *http.Client) es.Sink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &webhookSink{url: url, client: client}
+}
+
+func (s *webhookSink) Send(ctx context.Context, entry es.LogEntry) error {
+	id := base64.RawURLEncoding.EncodeToString(entry.Key.Bytes())
+	b, err := json.Marshal(WebhookPayload{
+		Seq:      entry.Seq,
+		ID:       id,
+		Time:     entry.Event.Time(),
+		EntityID: entry.Event.EntityID().String(),
+		Type:     entry.Event.Type(),
+		Body:     entry.Event.Body(),
+		Metadata: entry.Event.Metadata(),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyKeyHeader, id)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -1,12 +1,14 @@
 package eventstore
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
 	"sync"
 
 	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log"
 	"github.com/textileio/go-eventstore/core"
 )
@@ -27,20 +29,85 @@ type Store struct {
 	dispatcher *Dispatcher
 	eventcodec core.EventCodec
 	models     map[reflect.Type]*Model
+	signer     core.Signer
+	verifier   core.Verifier
+	quarantine bool
+	clock      core.Clock
+
+	modelsLock sync.RWMutex
+
+	replicaLock sync.Mutex
+	replicaID   string
+
+	syncLock   sync.Mutex
+	syncQueues map[string]*SyncQueue
+}
+
+// StoreOption configures optional behavior of a Store.
+type StoreOption func(*Store)
+
+// WithSigner makes the store sign every event generated by its transactions.
+func WithSigner(s core.Signer) StoreOption {
+	return func(store *Store) {
+		store.signer = s
+	}
+}
+
+// WithVerifier makes the store reject external events which aren't
+// signed or whose signature isn't valid for v.
+func WithVerifier(v core.Verifier) StoreOption {
+	return func(store *Store) {
+		store.verifier = v
+	}
 }
 
 // NewStore creates a new Store, which will *own* ds and dispatcher for internal use.
 // Saying it differently, ds and dispatcher shouldn't be used externally.
-func NewStore(ds ds.Datastore, dispatcher *Dispatcher, ec core.EventCodec) *Store {
-	return &Store{
-		datastore:  ds,
+// Models and projections are reduced concurrently, so ds is serialized
+// with a mutex unless it's a TxnDatastore, which must be safe for concurrent use.
+// The dispatcher, the codec and the store share a single clock: the one of
+// the dispatcher (see WithClock), or else the one of the codec.
+func NewStore(ds ds.Datastore, dispatcher *Dispatcher, ec core.EventCodec, opts ...StoreOption) *Store {
+	s := &Store{
+		datastore:  serialized(ds),
 		dispatcher: dispatcher,
 		eventcodec: ec,
 		models:     make(map[reflect.Type]*Model),
+		clock:      sharedClock(dispatcher, ec),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func (s *Store) Register(name string, defaultInstance interface{}) (*Model, error) {
+// serialized wraps d with a mutex, unless it's a TxnDatastore.
+func serialized(d ds.Datastore) ds.Datastore {
+	if _, ok := d.(ds.TxnDatastore); ok {
+		return d
+	}
+	return dssync.MutexWrap(d)
+}
+
+// sharedClock sets up a single clock for dispatcher and ec, and returns it.
+func sharedClock(dispatcher *Dispatcher, ec core.EventCodec) core.Clock {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	clocked, ok := ec.(core.Clocked)
+	if dispatcher.clock == nil {
+		if ok && clocked.Clock() != nil {
+			dispatcher.clock = clocked.Clock()
+		} else {
+			dispatcher.clock = core.NewHLC()
+		}
+	}
+	if ok {
+		clocked.SetClock(dispatcher.clock)
+	}
+	return dispatcher.clock
+}
+
+func (s *Store) Register(name string, defaultInstance interface{}, opts ...ModelOption) (*Model, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if s.alreadyRegistered(defaultInstance) {
@@ -52,8 +119,21 @@ func (s *Store) Register(name string, defaultInstance interface{}) (*Model, erro
 	}
 
 	m := NewModel(name, defaultInstance, s.datastore, s.dispatcher, s.eventcodec, s)
+	for _, opt := range opts {
+		opt(m)
+	}
+	s.modelsLock.Lock()
 	s.models[m.valueType] = m
-	s.dispatcher.Register(m)
+	s.modelsLock.Unlock()
+	// If the model can't catch up with the log, it's still registered
+	// and returned along with the error.
+	ropts := []ReducerOption{WithReducerName(name), withLegacyReduced()}
+	if m.policy != nil {
+		ropts = append(ropts, WithRetryPolicy(*m.policy))
+	}
+	if err := s.dispatcher.Register(m, ropts...); err != nil {
+		return m, err
+	}
 	return m, nil
 }
 
@@ -69,11 +149,18 @@ func (s *Store) readTxn(m *Model, f func(txn *Txn) error) error {
 	return nil
 }
 
-func (s *Store) writeTxn(m *Model, f func(txn *Txn) error) error {
+func (s *Store) writeTxn(ctx context.Context, m *Model, f func(txn *Txn) error) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	// Instances must reflect every persisted event
+	if err := s.waitReduced(m); err != nil {
+		return err
+	}
 	txn := &Txn{model: m}
+	if md, ok := core.MetadataFromContext(ctx); ok {
+		txn.metadata = md
+	}
 	defer txn.Discard()
 	if err := f(txn); err != nil {
 		return err
@@ -83,10 +170,79 @@ func (s *Store) writeTxn(m *Model, f func(txn *Txn) error) error {
 
 // Dispatch applies external events to the store. This function guarantee
 // no interference with registered model states, and viceversa.
-func (s *Store) Dispatch(e core.Event) {
+// If the store has a verifier, unsigned or tampered events are rejected
+// before being persisted or reduced, and so are events leaving their
+// instance not corresponding to its model schema, unless the store
+// quarantines them (see WithQuarantine). Events already in the store are
+// skipped, and reported with the Duplicate status.
+func (s *Store) Dispatch(e core.Event) (DispatchStatus, error) {
+	statuses, err := s.DispatchBatch([]core.Event{e})
+	if statuses == nil {
+		return Rejected, err
+	}
+	return statuses[0], err
+}
+
+// waitReduced blocks until models reduced every persisted event, if the
+// dispatcher reduces asynchronously or is retrying their failed reductions.
+// Writers don't wait for other reducers, e.g. projections.
+func (s *Store) waitReduced(models ...*Model) error {
+	last, err := s.dispatcher.LastSeq()
+	if err != nil {
+		return err
+	}
+	reducers := make([]Reducer, len(models))
+	for i, m := range models {
+		reducers[i] = m
+	}
+	return s.dispatcher.waitReducers(context.Background(), last, reducers...)
+}
+
+// DispatchBatch is like Dispatch, but persists all the events in a single
+// write before reducing them in order. If any event is rejected, none of
+// them are dispatched. It returns the status of each event, also along
+// with the error of a failed reduction, since the events were persisted.
+func (s *Store) DispatchBatch(events []core.Event) ([]DispatchStatus, error) {
+	if s.verifier != nil {
+		for _, e := range events {
+			if err := core.VerifyEvent(e, s.verifier); err != nil {
+				return nil, fmt.Errorf("rejected event from %s: %w", e.EntityID(), err)
+			}
+		}
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.dispatcher.Dispatch(e)
+	reasons, err := s.validateBatch(events)
+	if err != nil {
+		return nil, err
+	}
+	valid := make([]core.Event, 0, len(events))
+	for i, e := range events {
+		if reasons[i] == nil {
+			valid = append(valid, e)
+			continue
+		}
+		if !s.quarantine {
+			return nil, fmt.Errorf("rejected event from %s: %w", e.EntityID(), reasons[i])
+		}
+		log.Warningf("quarantining event from %s: %v", e.EntityID(), reasons[i])
+		if err := s.putQuarantined(e, reasons[i]); err != nil {
+			return nil, err
+		}
+	}
+	dispatched, err := s.dispatcher.dispatchBatch(valid)
+	if dispatched == nil {
+		return nil, err
+	}
+	statuses := make([]DispatchStatus, len(events))
+	for i := range events {
+		if reasons[i] != nil {
+			statuses[i] = Quarantined
+			continue
+		}
+		statuses[i], dispatched = dispatched[0], dispatched[1:]
+	}
+	return statuses, err
 }
 
 func (s *Store) alreadyRegistered(t interface{}) bool {
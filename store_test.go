@@ -0,0 +1,170 @@
+package eventstore
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/signature"
+)
+
+func TestSignedDispatch(t *testing.T) {
+	t.Parallel()
+
+	signer, err := signature.GenerateEd25519Signer()
+	checkErr(t, err)
+	source := createTestStore(WithSigner(signer))
+	m, err := source.Register("Person", &Person{})
+	checkErr(t, err)
+	rec := &recorderReducer{}
+	source.dispatcher.Register(rec)
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+	if len(rec.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(rec.events))
+	}
+	signed := rec.events[0]
+
+	verifier := signature.NewEd25519Verifier(ed25519.PublicKey(signer.PublicKey()))
+	t.Run("Valid", func(t *testing.T) {
+		t.Parallel()
+		target := createTestStore(WithVerifier(verifier))
+		tm, err := target.Register("Person", &Person{})
+		checkErr(t, err)
+		_, err = target.Dispatch(signed)
+		checkErr(t, err)
+		assertPersonInModel(t, tm, p)
+	})
+	t.Run("Unsigned", func(t *testing.T) {
+		t.Parallel()
+		target := createTestStore(WithVerifier(verifier))
+		tm, err := target.Register("Person", &Person{})
+		checkErr(t, err)
+		unsigned := &tamperedEvent{Event: signed}
+		status, err := target.Dispatch(unsigned)
+		if !errors.Is(err, core.ErrUnsignedEvent) {
+			t.Fatalf("unsigned event should be rejected, got: %v", err)
+		}
+		if status != Rejected {
+			t.Fatalf("expected rejected status, got %s", status)
+		}
+		if exists, err := tm.Has(p.ID); exists || err != nil {
+			t.Fatal("rejected event shouldn't be reduced")
+		}
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		t.Parallel()
+		target := createTestStore(WithVerifier(verifier))
+		tm, err := target.Register("Person", &Person{})
+		checkErr(t, err)
+		tampered := &tamperedEvent{
+			Event: signed,
+			body:  []byte(`{"Type":0,"JSONPatch":{"Name":"Evil","Age":1}}`),
+		}
+		if _, err := target.Dispatch(tampered); !errors.Is(err, core.ErrInvalidSignature) {
+			t.Fatalf("tampered event should be rejected, got: %v", err)
+		}
+		if exists, err := tm.Has(p.ID); exists || err != nil {
+			t.Fatal("rejected event shouldn't be reduced")
+		}
+	})
+}
+
+func TestDuplicateDispatch(t *testing.T) {
+	t.Parallel()
+	source := createTestStore()
+	m, err := source.Register("Person", &Person{})
+	checkErr(t, err)
+	rec := &recorderReducer{}
+	checkErr(t, source.dispatcher.Register(rec))
+	p := &Person{Name: "Foo", Age: 42}
+	checkErr(t, m.Create(p))
+	e := rec.events[0]
+	if e.Metadata().EventID == "" {
+		t.Fatal("events should have an ID")
+	}
+
+	target := createTestStore()
+	tm, err := target.Register("Person", &Person{})
+	checkErr(t, err)
+	status, err := target.Dispatch(e)
+	checkErr(t, err)
+	if status != Dispatched {
+		t.Fatalf("expected dispatched status, got %s", status)
+	}
+	assertPersonInModel(t, tm, p)
+
+	// Resent events are skipped instead of reduced again
+	resent := &testEvent{
+		Timestamp: time.Now(),
+		ID:        e.EntityID(),
+		TypeName:  e.Type(),
+		Payload:   e.Body(),
+		Meta:      e.Metadata(),
+	}
+	statuses, err := target.DispatchBatch([]core.Event{e, resent})
+	checkErr(t, err)
+	if statuses[0] != Duplicate || statuses[1] != Duplicate {
+		t.Fatalf("expected duplicate statuses, got %v", statuses)
+	}
+	seq, err := target.dispatcher.LastSeq()
+	checkErr(t, err)
+	if seq != 1 {
+		t.Fatalf("duplicates shouldn't be persisted, got %d events", seq)
+	}
+}
+
+// tamperedEvent wraps a signed event replacing its body. If the wrapped
+// event body is kept, it loses its signature.
+type tamperedEvent struct {
+	core.Event
+	body []byte
+}
+
+func (e *tamperedEvent) Body() []byte {
+	if e.body == nil {
+		return e.Event.Body()
+	}
+	return e.body
+}
+
+func (e *tamperedEvent) PublicKey() []byte {
+	if e.body == nil {
+		return nil
+	}
+	return e.Event.(core.SignedEvent).PublicKey()
+}
+
+func (e *tamperedEvent) Signature() []byte {
+	if e.body == nil {
+		return nil
+	}
+	return e.Event.(core.SignedEvent).Signature()
+}
+
+func TestDispatchReduceError(t *testing.T) {
+	t.Parallel()
+	source := createTestStore()
+	m, err := source.Register("Person", &Person{})
+	checkErr(t, err)
+	rec := &recorderReducer{}
+	checkErr(t, source.dispatcher.Register(rec))
+	checkErr(t, m.Create(&Person{Name: "Foo", Age: 42}))
+
+	// Events which fail to reduce are persisted, so they aren't rejected
+	target := createTestStore()
+	_, err = target.Register("Person", &Person{})
+	checkErr(t, err)
+	checkErr(t, target.dispatcher.Register(&flakyReducer{failures: 1}))
+	status, err := target.Dispatch(rec.events[0])
+	if err != errFlaky || status != Dispatched {
+		t.Fatalf("expected dispatched status along the reducer error, got %s: %v", status, err)
+	}
+	status, err = target.Dispatch(rec.events[0])
+	checkErr(t, err)
+	if status != Duplicate {
+		t.Fatalf("expected duplicate status, got %s", status)
+	}
+}
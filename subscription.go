@@ -0,0 +1,200 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// subscriptionPageSize is the maximum number of events read at once
+	subscriptionPageSize = 100
+)
+
+var (
+	subscriptionsPrefix = datastore.NewKey("/subscriptions")
+
+	// ErrSubscriptionClosed indicates the subscription was closed
+	ErrSubscriptionClosed = errors.New("subscription is closed")
+	// ErrInvalidOffset indicates an offset after the last event in the log
+	ErrInvalidOffset = errors.New("offset is ahead of the log")
+)
+
+// Subscription is a durable consumer of the event log. Its offset is the
+// sequence of the last acknowledged event, and is persisted in the event
+// store, so subscribing again with the same name resumes right after it.
+// Events are delivered once persisted, in log order. A subscription should
+// have a single consumer at a time.
+type Subscription struct {
+	name   string
+	filter EventFilter
+	d      *Dispatcher
+
+	lock    sync.Mutex
+	next    uint64
+	pending []LogEntry
+
+	wake   <-chan struct{}
+	stop   func()
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Subscribe opens the durable subscription named name, delivering events
+// accepted by filter after its offset. A nil filter accepts every event.
+func (d *Dispatcher) Subscribe(name string, filter EventFilter) (*Subscription, error) {
+	offset, err := d.loadOffset(name)
+	if err != nil {
+		return nil, err
+	}
+	wake, stop := d.watch()
+	return &Subscription{
+		name:   name,
+		filter: filter,
+		d:      d,
+		next:   offset + 1,
+		wake:   wake,
+		stop:   stop,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Subscriptions returns the offsets of every subscription, by name.
+func (d *Dispatcher) Subscriptions() (map[string]uint64, error) {
+	res, err := d.store.Query(query.Query{Prefix: subscriptionsPrefix.String() + "/"})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]uint64, len(entries))
+	for _, e := range entries {
+		offset, err := strconv.ParseUint(string(e.Value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		offsets[strings.TrimPrefix(e.Key, subscriptionsPrefix.String()+"/")] = offset
+	}
+	return offsets, nil
+}
+
+// DeleteSubscription removes the offset of the subscription named name.
+func (d *Dispatcher) DeleteSubscription(name string) error {
+	return d.store.Delete(subscriptionsPrefix.ChildString(name))
+}
+
+// Name returns the name of the subscription.
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+// Offset returns the sequence of the last acknowledged event.
+func (s *Subscription) Offset() (uint64, error) {
+	return s.d.loadOffset(s.name)
+}
+
+// Next returns the next event of the subscription, blocking until
+// there's one, ctx is done, or the subscription is closed.
+func (s *Subscription) Next(ctx context.Context) (LogEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.pending) == 0 {
+		select {
+		case <-s.closed:
+			return LogEntry{}, ErrSubscriptionClosed
+		default:
+		}
+		last, err := s.d.LastSeq()
+		if err != nil {
+			return LogEntry{}, err
+		}
+		if last >= s.next {
+			// Events are read in pages, so large backlogs aren't loaded at once
+			to := s.next + subscriptionPageSize - 1
+			if to > last {
+				to = last
+			}
+			if s.pending, err = s.d.Events(ctx, s.next, to, s.filter); err != nil {
+				return LogEntry{}, err
+			}
+			s.next = to + 1
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return LogEntry{}, ctx.Err()
+		case <-s.closed:
+			return LogEntry{}, ErrSubscriptionClosed
+		case <-s.wake:
+		}
+	}
+	e := s.pending[0]
+	s.pending = s.pending[1:]
+	return e, nil
+}
+
+// Ack acknowledges every event up to seq as processed, moving the offset
+// forward. Acknowledging an event before the offset has no effect.
+func (s *Subscription) Ack(seq uint64) error {
+	last, err := s.d.LastSeq()
+	if err != nil {
+		return err
+	}
+	if seq > last {
+		return ErrInvalidOffset
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset, err := s.Offset()
+	if err != nil {
+		return err
+	}
+	if seq <= offset {
+		return nil
+	}
+	return s.d.store.Put(subscriptionsPrefix.ChildString(s.name), []byte(strconv.FormatUint(seq, 10)))
+}
+
+// Seek makes Next deliver the events after offset, without
+// changing the acknowledged offset.
+func (s *Subscription) Seek(offset uint64) error {
+	last, err := s.d.LastSeq()
+	if err != nil {
+		return err
+	}
+	if offset > last {
+		return ErrInvalidOffset
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.next = offset + 1
+	s.pending = nil
+	return nil
+}
+
+// Close stops the subscription, unblocking pending Next calls.
+func (s *Subscription) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.stop()
+	})
+	return nil
+}
+
+func (d *Dispatcher) loadOffset(name string) (uint64, error) {
+	b, err := d.store.Get(subscriptionsPrefix.ChildString(name))
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
@@ -0,0 +1,117 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestSubscription(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(time.Duration(i)))))
+	}
+
+	ctx := context.Background()
+	sub, err := dispatcher.Subscribe("consumer", nil)
+	checkErr(t, err)
+	for i := uint64(1); i <= 3; i++ {
+		assertNext(t, sub, i)
+	}
+	checkErr(t, sub.Ack(2))
+	if err := sub.Ack(4); err != ErrInvalidOffset {
+		t.Fatalf("expected invalid offset error, got: %v", err)
+	}
+	checkErr(t, sub.Close())
+	if _, err := sub.Next(ctx); err != ErrSubscriptionClosed {
+		t.Fatalf("expected subscription closed error, got: %v", err)
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		checkErr(t, dispatcher.Dispatch(core.NewNullEvent(now.Add(3))))
+		sub, err := dispatcher.Subscribe("consumer", nil)
+		checkErr(t, err)
+		defer sub.Close()
+		assertNext(t, sub, 3)
+		assertNext(t, sub, 4)
+		checkErr(t, sub.Ack(4))
+		checkErr(t, sub.Ack(1))
+		offsets, err := dispatcher.Subscriptions()
+		checkErr(t, err)
+		if len(offsets) != 1 || offsets["consumer"] != 4 {
+			t.Fatalf("unexpected offsets: %v", offsets)
+		}
+
+		checkErr(t, sub.Seek(1))
+		assertNext(t, sub, 2)
+		offset, err := sub.Offset()
+		checkErr(t, err)
+		if offset != 4 {
+			t.Fatalf("seek shouldn't change the offset, got %d", offset)
+		}
+	})
+	t.Run("Wait", func(t *testing.T) {
+		sub, err := dispatcher.Subscribe("waiter", ByType("other"))
+		checkErr(t, err)
+		defer sub.Close()
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := sub.Next(timeout); err != context.DeadlineExceeded {
+			t.Fatalf("expected deadline exceeded error, got: %v", err)
+		}
+
+		next := make(chan LogEntry)
+		go func() {
+			e, err := sub.Next(ctx)
+			if err != nil {
+				t.Errorf("unexpected error in next call: %v", err)
+			}
+			next <- e
+		}()
+		e := &testEvent{Timestamp: now.Add(4), ID: "entity", TypeName: "other"}
+		checkErr(t, dispatcher.Dispatch(e))
+		select {
+		case got := <-next:
+			if got.Seq != 5 || got.Event.Type() != "other" {
+				t.Fatalf("unexpected entry %d of type %s", got.Seq, got.Event.Type())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("dispatched event should be delivered")
+		}
+	})
+}
+
+func TestSubscriptionPages(t *testing.T) {
+	t.Parallel()
+	dispatcher := NewDispatcher(NewTxMapDatastore())
+	now := time.Now()
+	events := make([]core.Event, subscriptionPageSize*2+1)
+	for i := range events {
+		events[i] = core.NewNullEvent(now.Add(time.Duration(i)))
+	}
+	_, err := dispatcher.dispatchBatch(events)
+	checkErr(t, err)
+
+	sub, err := dispatcher.Subscribe("consumer", nil)
+	checkErr(t, err)
+	defer sub.Close()
+	for i := range events {
+		assertNext(t, sub, uint64(i+1))
+		if len(sub.pending) >= subscriptionPageSize {
+			t.Fatalf("expected less than %d pending events, got %d", subscriptionPageSize, len(sub.pending))
+		}
+	}
+}
+
+func assertNext(t *testing.T, sub *Subscription, seq uint64) {
+	t.Helper()
+	e, err := sub.Next(context.Background())
+	checkErr(t, err)
+	if e.Seq != seq {
+		t.Fatalf("expected event %d, got %d", seq, e.Seq)
+	}
+}
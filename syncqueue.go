@@ -0,0 +1,211 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+var (
+	syncQueuesPrefix = datastore.NewKey("/syncqueues")
+)
+
+// SyncQueue holds the events created by the store which a peer didn't
+// acknowledge yet, e.g. written while offline. It's kept in the event
+// log: events up to an offset are acknowledged, and so are the ones
+// after it acknowledged individually.
+type SyncQueue struct {
+	store *Store
+	peer  string
+	lock  sync.Mutex
+}
+
+// SyncQueue returns the queue of events not acknowledged yet by peer.
+// Every call with the same peer returns the same queue.
+func (s *Store) SyncQueue(peer string) *SyncQueue {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	if s.syncQueues == nil {
+		s.syncQueues = make(map[string]*SyncQueue)
+	}
+	q, ok := s.syncQueues[peer]
+	if !ok {
+		q = &SyncQueue{store: s, peer: peer}
+		s.syncQueues[peer] = q
+	}
+	return q
+}
+
+// Pending returns the events created by the store which weren't
+// acknowledged by the peer, in log order.
+func (q *SyncQueue) Pending(ctx context.Context) ([]LogEntry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	pending, _, err := q.pending(ctx)
+	return pending, err
+}
+
+// Ack marks the events with the given sequences as acknowledged by the peer.
+func (q *SyncQueue) Ack(seqs ...uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	d := q.store.dispatcher
+	for _, seq := range seqs {
+		if err := d.store.Put(q.ackKey(seq), nil); err != nil {
+			return err
+		}
+	}
+	// Acknowledged events before the first pending one are compacted in the
+	// offset. Events appended after the scan may be pending too.
+	pending, scanned, err := q.pending(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return q.ackUpTo(pending[0].Seq - 1)
+	}
+	return q.ackUpTo(scanned)
+}
+
+// AckUpTo marks every event up to seq as acknowledged by the peer.
+func (q *SyncQueue) AckUpTo(seq uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.ackUpTo(seq)
+}
+
+// pending returns the pending events, and the sequence up to which the
+// log was scanned for them.
+func (q *SyncQueue) pending(ctx context.Context) ([]LogEntry, uint64, error) {
+	replica, err := q.store.ReplicaID()
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := q.loadOffset()
+	if err != nil {
+		return nil, 0, err
+	}
+	last, err := q.store.dispatcher.LastSeq()
+	if err != nil || last <= offset {
+		return nil, offset, err
+	}
+	local := func(e core.Event) bool {
+		return e.Metadata().Origin == replica
+	}
+	entries, err := q.store.dispatcher.Events(ctx, offset+1, last, local)
+	if err != nil {
+		return nil, 0, err
+	}
+	pending := entries[:0]
+	for _, e := range entries {
+		acked, err := q.store.dispatcher.store.Has(q.ackKey(e.Seq))
+		if err != nil {
+			return nil, 0, err
+		}
+		if !acked {
+			pending = append(pending, e)
+		}
+	}
+	return pending, last, nil
+}
+
+func (q *SyncQueue) ackUpTo(seq uint64) error {
+	offset, err := q.loadOffset()
+	if err != nil || seq <= offset {
+		return err
+	}
+	d := q.store.dispatcher
+	if err := d.store.Put(q.key().ChildString("offset"), []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return err
+	}
+	res, err := d.store.Query(query.Query{
+		Prefix:   q.key().ChildString("acks").String() + "/",
+		KeysOnly: true,
+		Filters: []query.Filter{query.FilterKeyCompare{
+			Op:  query.LessThanOrEqual,
+			Key: q.ackKey(seq).String(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	acks, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, a := range acks {
+		if err := d.store.Delete(datastore.RawKey(a.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *SyncQueue) loadOffset() (uint64, error) {
+	b, err := q.store.dispatcher.store.Get(q.key().ChildString("offset"))
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+func (q *SyncQueue) key() datastore.Key {
+	return syncQueuesPrefix.ChildString(url.PathEscape(q.peer))
+}
+
+func (q *SyncQueue) ackKey(seq uint64) datastore.Key {
+	return q.key().ChildString("acks").ChildString(fmt.Sprintf("%020d", seq))
+}
+
+// PushPending sends to the peer at addr the events of its SyncQueue, and
+// acknowledges them once the peer received them. It returns how many
+// events were sent. Events created while offline are sent again by
+// calling it once the peer is reachable.
+func (r *Replicator) PushPending(ctx context.Context, addr string) (int, error) {
+	q := r.store.SyncQueue(addr)
+	pending, err := q.Pending(ctx)
+	if err != nil || len(pending) == 0 {
+		return 0, err
+	}
+	peer, err := r.transport.Dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	if c, ok := peer.(io.Closer); ok {
+		defer c.Close()
+	}
+	var sent int
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > replicationBatchSize {
+			n = replicationBatchSize
+		}
+		records := make([][]byte, n)
+		seqs := make([]uint64, n)
+		for i, e := range pending[:n] {
+			if records[i], err = r.store.dispatcher.store.Get(eventsPrefix.Child(e.Key)); err != nil {
+				return sent, err
+			}
+			seqs[i] = e.Seq
+		}
+		if err := peer.Push(ctx, records); err != nil {
+			return sent, err
+		}
+		if err := q.Ack(seqs...); err != nil {
+			return sent, err
+		}
+		sent += n
+		pending = pending[n:]
+	}
+	return sent, nil
+}
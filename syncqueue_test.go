@@ -0,0 +1,146 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSyncQueue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := peers{}
+	a, b, c := createTestStore(), createTestStore(), createTestStore()
+	ra, rb, rc := NewReplicator(a, transport), NewReplicator(b, transport), NewReplicator(c, transport)
+	transport["c"] = rc
+	ma, err := a.Register("Person", &Person{})
+	checkErr(t, err)
+	mb, err := b.Register("Person", &Person{})
+	checkErr(t, err)
+	mc, err := c.Register("Person", &Person{})
+	checkErr(t, err)
+
+	// b writes while a is unreachable, and receives events from c
+	p1, p2, p3 := &Person{Name: "Foo", Age: 42}, &Person{Name: "Bar", Age: 43}, &Person{Name: "Baz", Age: 44}
+	checkErr(t, mb.Create(p1, p2))
+	checkErr(t, mc.Create(p3))
+	checkErr(t, rb.Sync(ctx, "c"))
+	if _, err := rb.PushPending(ctx, "a"); err != ErrUnknownPeer {
+		t.Fatalf("expected unknown peer error, got: %v", err)
+	}
+	assertPending(t, b.SyncQueue("a"), 2)
+	assertPending(t, b.SyncQueue("c"), 0)
+
+	t.Run("FailedPush", func(t *testing.T) {
+		transport["a"] = &failingPeer{Peer: ra}
+		if _, err := rb.PushPending(ctx, "a"); err != errPushFailed {
+			t.Fatalf("expected push error, got: %v", err)
+		}
+		assertPending(t, b.SyncQueue("a"), 2)
+	})
+	t.Run("Reconnect", func(t *testing.T) {
+		transport["a"] = ra
+		n, err := rb.PushPending(ctx, "a")
+		checkErr(t, err)
+		if n != 2 {
+			t.Fatalf("expected 2 events sent, got %d", n)
+		}
+		assertPending(t, b.SyncQueue("a"), 0)
+		assertPersonInModel(t, ma, p1)
+		assertPersonInModel(t, ma, p2)
+	})
+	t.Run("Ack", func(t *testing.T) {
+		q := b.SyncQueue("d")
+		pending := assertPending(t, q, 2)
+		checkErr(t, q.Ack(pending[1].Seq))
+		assertPending(t, q, 1)
+		checkErr(t, q.Ack(pending[0].Seq))
+		assertPending(t, q, 0)
+		offset, err := q.loadOffset()
+		checkErr(t, err)
+		last, err := b.dispatcher.LastSeq()
+		checkErr(t, err)
+		if offset != last {
+			t.Fatalf("acks should be compacted up to %d, got offset %d", last, offset)
+		}
+
+		p1.Age = 50
+		checkErr(t, mb.Save(p1))
+		if pending := assertPending(t, q, 1); pending[0].Event.EntityID() != p1.ID {
+			t.Fatalf("expected pending event of %s, got %s", p1.ID, pending[0].Event.EntityID())
+		}
+	})
+	t.Run("Sync", func(t *testing.T) {
+		checkErr(t, rb.Sync(ctx, "a"))
+		assertPending(t, b.SyncQueue("a"), 0)
+	})
+}
+
+func TestSyncQueueConcurrentAck(t *testing.T) {
+	t.Parallel()
+	s := createTestStore()
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+	if s.SyncQueue("a") != s.SyncQueue("a") {
+		t.Fatal("a peer should have a single queue")
+	}
+
+	// Events written while acknowledging are still sent
+	const n = 100
+	done := make(chan error)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := m.Create(&Person{Name: "Foo", Age: i}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	sent := make(map[uint64]bool)
+	ack := func() {
+		q := s.SyncQueue("a")
+		pending, err := q.Pending(context.Background())
+		checkErr(t, err)
+		seqs := make([]uint64, len(pending))
+		for i, e := range pending {
+			seqs[i] = e.Seq
+			sent[e.Seq] = true
+		}
+		checkErr(t, q.Ack(seqs...))
+	}
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			checkErr(t, err)
+			writing = false
+		default:
+		}
+		ack()
+	}
+	ack()
+	if len(sent) != n {
+		t.Fatalf("expected %d events sent, got %d", n, len(sent))
+	}
+}
+
+var errPushFailed = errors.New("push failed")
+
+// failingPeer is a Peer rejecting every push.
+type failingPeer struct {
+	Peer
+}
+
+func (p *failingPeer) Push(context.Context, [][]byte) error {
+	return errPushFailed
+}
+
+func assertPending(t *testing.T, q *SyncQueue, n int) []LogEntry {
+	t.Helper()
+	pending, err := q.Pending(context.Background())
+	checkErr(t, err)
+	if len(pending) != n {
+		t.Fatalf("expected %d pending events, got %d", n, len(pending))
+	}
+	return pending
+}
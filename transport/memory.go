@@ -0,0 +1,48 @@
+// Package transport provides eventstore.Transport implementations to
+// replicate event logs between nodes.
+package transport
+
+import (
+	"context"
+	"sync"
+
+	es "github.com/textileio/go-eventstore"
+)
+
+// Memory is an in-process es.Transport, connecting peers served in it by address.
+type Memory struct {
+	lock  sync.RWMutex
+	peers map[string]es.Peer
+}
+
+var _ es.Transport = (*Memory)(nil)
+
+// NewMemory returns an empty in-process transport.
+func NewMemory() *Memory {
+	return &Memory{peers: make(map[string]es.Peer)}
+}
+
+// Serve makes peer reachable at addr.
+func (m *Memory) Serve(addr string, peer es.Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.peers[addr] = peer
+}
+
+// Remove makes the peer at addr unreachable.
+func (m *Memory) Remove(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.peers, addr)
+}
+
+// Dial returns the peer served at addr.
+func (m *Memory) Dial(ctx context.Context, addr string) (es.Peer, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	peer, ok := m.peers[addr]
+	if !ok {
+		return nil, es.ErrUnknownPeer
+	}
+	return peer, nil
+}
@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	es "github.com/textileio/go-eventstore"
+)
+
+var (
+	log = logging.Logger("transport")
+)
+
+type op byte
+
+const (
+	opHead op = iota + 1
+	opRecords
+	opPush
+)
+
+// request is a call to the remote peer, gob encoded on the connection.
+type request struct {
+	Op      op
+	After   uint64
+	Limit   int
+	Records [][]byte
+}
+
+// response is the result of a request.
+type response struct {
+	Head    es.LogHead
+	Records [][]byte
+	Err     string
+}
+
+// TCP is an es.Transport connecting to peers served with ListenTCP.
+type TCP struct {
+	dialer net.Dialer
+}
+
+var _ es.Transport = (*TCP)(nil)
+
+// NewTCP returns a TCP transport.
+func NewTCP() *TCP {
+	return &TCP{}
+}
+
+// Dial connects to the peer listening at addr.
+func (t *TCP) Dial(ctx context.Context, addr string) (es.Peer, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpPeer{
+		conn: conn,
+		enc:  gob.NewEncoder(conn),
+		dec:  gob.NewDecoder(conn),
+	}, nil
+}
+
+// tcpPeer is a connection to a remote peer. Requests are sent one at a time.
+type tcpPeer struct {
+	lock sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+func (p *tcpPeer) Head(ctx context.Context) (es.LogHead, error) {
+	res, err := p.call(ctx, request{Op: opHead})
+	return res.Head, err
+}
+
+func (p *tcpPeer) Records(ctx context.Context, after uint64, limit int) ([][]byte, error) {
+	res, err := p.call(ctx, request{Op: opRecords, After: after, Limit: limit})
+	return res.Records, err
+}
+
+func (p *tcpPeer) Push(ctx context.Context, records [][]byte) error {
+	_, err := p.call(ctx, request{Op: opPush, Records: records})
+	return err
+}
+
+func (p *tcpPeer) Close() error {
+	return p.conn.Close()
+}
+
+func (p *tcpPeer) call(ctx context.Context, req request) (response, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	deadline, _ := ctx.Deadline()
+	if err := p.conn.SetDeadline(deadline); err != nil {
+		return response{}, err
+	}
+	var res response
+	if err := p.enc.Encode(req); err != nil {
+		return res, err
+	}
+	if err := p.dec.Decode(&res); err != nil {
+		return res, err
+	}
+	if res.Err != "" {
+		return res, errors.New(res.Err)
+	}
+	return res, nil
+}
+
+// TCPServer serves a peer to TCP transports.
+type TCPServer struct {
+	listener net.Listener
+	peer     es.Peer
+	wg       sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// ListenTCP serves peer at addr. Use port 0 to listen on any free port.
+func ListenTCP(addr string, peer es.Peer) (*TCPServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &TCPServer{
+		listener: l,
+		peer:     peer,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens at.
+func (s *TCPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening and closes open connections.
+func (s *TCPServer) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *TCPServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *TCPServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		_ = conn.Close()
+	}()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		res := s.handle(req)
+		if err := enc.Encode(res); err != nil {
+			log.Errorf("error when responding to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *TCPServer) handle(req request) response {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var res response
+	var err error
+	switch req.Op {
+	case opHead:
+		res.Head, err = s.peer.Head(ctx)
+	case opRecords:
+		res.Records, err = s.peer.Records(ctx, req.After, req.Limit)
+	case opPush:
+		err = s.peer.Push(ctx, req.Records)
+	default:
+		err = errors.New("unknown operation")
+	}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	return res
+}
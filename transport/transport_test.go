@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	es "github.com/textileio/go-eventstore"
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+)
+
+type person struct {
+	ID   core.EntityID
+	Name string
+	Age  int
+}
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+	transport := NewMemory()
+	a, b := newNode(t, transport), newNode(t, transport)
+	transport.Serve("a", a.replicator)
+	transport.Serve("b", b.replicator)
+	testSync(t, a, b, "a")
+
+	transport.Remove("a")
+	if err := b.replicator.Sync(context.Background(), "a"); err != es.ErrUnknownPeer {
+		t.Fatalf("expected unknown peer error, got: %v", err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	t.Parallel()
+	transport := NewTCP()
+	a, b := newNode(t, transport), newNode(t, transport)
+	server, err := ListenTCP("127.0.0.1:0", a.replicator)
+	checkErr(t, err)
+	defer server.Close()
+	testSync(t, a, b, server.Addr())
+}
+
+type node struct {
+	replicator *es.Replicator
+	dispatcher *es.Dispatcher
+	model      *es.Model
+}
+
+func newNode(t *testing.T, transport es.Transport) *node {
+	dispatcher := es.NewDispatcher(es.NewTxMapDatastore())
+	store := es.NewStore(ds.NewMapDatastore(), dispatcher, jsonpatcher.New())
+	m, err := store.Register("Person", &person{})
+	checkErr(t, err)
+	return &node{replicator: es.NewReplicator(store, transport), dispatcher: dispatcher, model: m}
+}
+
+// testSync makes b sync with a at addr after changes in both nodes.
+func testSync(t *testing.T, a, b *node, addr string) {
+	t.Helper()
+	ctx := context.Background()
+	p1, p2 := &person{Name: "Foo", Age: 42}, &person{Name: "Bar", Age: 43}
+	checkErr(t, a.model.Create(p1))
+	checkErr(t, b.model.Create(p2))
+	checkErr(t, b.replicator.Sync(ctx, addr))
+	p1.Age = 50
+	checkErr(t, b.model.Save(p1))
+	checkErr(t, b.replicator.Sync(ctx, addr))
+
+	// Concurrent events are ordered differently in each log
+	ka, kb := eventKeys(t, a), eventKeys(t, b)
+	if len(ka) != 3 || !reflect.DeepEqual(ka, kb) {
+		t.Fatalf("logs should hold the same 3 events, got %v and %v", ka, kb)
+	}
+	for _, n := range []*node{a, b} {
+		for _, p := range []*person{p1, p2} {
+			var got person
+			checkErr(t, n.model.FindByID(p.ID, &got))
+			if !reflect.DeepEqual(&got, p) {
+				t.Fatalf("expected %v in model, got %v", p, got)
+			}
+		}
+	}
+}
+
+func eventKeys(t *testing.T, n *node) map[string]struct{} {
+	t.Helper()
+	entries, err := n.dispatcher.Events(context.Background(), 1, 0, nil)
+	checkErr(t, err)
+	keys := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		keys[e.Key.String()] = struct{}{}
+	}
+	return keys
+}
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package eventstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// journalHeaderSize is the size of the header of a journal entry: the
+// length and the CRC-32 checksum of its payload.
+const journalHeaderSize = 8
+
+// journalOp is the persisted form of a write of a commit.
+type journalOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// OpenTxMapDatastore returns a TxMapDatastore persisted to the journal file
+// at path, which is created if it doesn't exist. Every commit is appended
+// to the journal and synced before being applied, and the journal is
+// replayed on open. A commit interrupted by a crash is discarded, along
+// with anything after it. The journal keeps every commit, so it grows
+// with every write. Close the datastore to close the journal.
+func OpenTxMapDatastore(path string) (*TxMapDatastore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d := NewTxMapDatastore()
+	end, err := d.replay(f)
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.journal = f
+	return d, nil
+}
+
+// replay applies the commits of the journal f, returning the offset
+// after the last complete one.
+func (d *TxMapDatastore) replay(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(f)
+	var end int64
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return end, nil
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		if end+journalHeaderSize+size > info.Size() {
+			return end, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return end, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return end, nil
+		}
+		var jops []journalOp
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&jops); err != nil {
+			return end, err
+		}
+		ops := make(map[datastore.Key]op, len(jops))
+		for _, o := range jops {
+			ops[datastore.RawKey(o.Key)] = op{value: o.Value, delete: o.Delete}
+		}
+		d.apply(ops)
+		end += int64(journalHeaderSize + len(payload))
+	}
+}
+
+// writeJournal appends ops to the journal f as a single entry, and syncs
+// it. Entries which fail to be written are removed, so they don't hide the
+// following ones when replayed.
+func writeJournal(f *os.File, ops map[datastore.Key]op) error {
+	jops := make([]journalOp, 0, len(ops))
+	for k, o := range ops {
+		jops = append(jops, journalOp{Key: k.String(), Value: o.value, Delete: o.delete})
+	}
+	sort.Slice(jops, func(i, j int) bool { return jops[i].Key < jops[j].Key })
+	payload := bytes.Buffer{}
+	if err := gob.NewEncoder(&payload).Encode(jops); err != nil {
+		return err
+	}
+	entry := make([]byte, journalHeaderSize, journalHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(entry, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(entry[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(entry, payload.Bytes()...))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if terr := f.Truncate(end); terr == nil {
+			_, _ = f.Seek(end, io.SeekStart)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package eventstore
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrTxnConflict indicates a transaction read or wrote keys changed by
+	// another transaction committed after it started. None of its writes
+	// were applied, and it can be retried.
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone indicates the transaction was already committed or discarded
+	ErrTxnDone = errors.New("transaction already committed or discarded")
+)
+
+// TxMapDatastore is an in-memory TxnDatastore, which can be persisted to
+// a journal file (see OpenTxMapDatastore). Transactions read from a
+// snapshot of the datastore taken when they're created, along with their
+// own pending writes, and apply all their writes at once on Commit. A
+// transaction fails to commit with ErrTxnConflict if another one changed
+// meanwhile a key it read, queried or wrote. Writes made outside
+// transactions are committed right away. Query results are sorted by key
+// unless other orders are given.
+// It's safe for concurrent use.
+type TxMapDatastore struct {
+	lock sync.RWMutex
+	// values holds the versions of each key, oldest first
+	values map[datastore.Key][]txMapValue
+	// version is the version of the last commit
+	version uint64
+	// snapshots counts the open transactions reading each version
+	snapshots map[uint64]int
+	// commits are the commits newer than the oldest open snapshot
+	commits []txMapCommit
+	// journal persists every commit, if not nil
+	journal *os.File
+}
+
+var _ datastore.TxnDatastore = (*TxMapDatastore)(nil)
+var _ datastore.Batching = (*TxMapDatastore)(nil)
+
+type txMapValue struct {
+	version uint64
+	deleted bool
+	value   []byte
+}
+
+type txMapCommit struct {
+	version uint64
+	keys    []datastore.Key
+}
+
+// NewTxMapDatastore returns an empty TxMapDatastore.
+func NewTxMapDatastore() *TxMapDatastore {
+	return &TxMapDatastore{
+		values:    make(map[datastore.Key][]txMapValue),
+		snapshots: make(map[uint64]int),
+	}
+}
+
+// NewTransaction returns a transaction reading from the current snapshot.
+// Writes of read-only transactions fail with ErrReadonlyTx.
+func (d *TxMapDatastore) NewTransaction(readOnly bool) (datastore.Txn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.snapshots[d.version]++
+	return &txMapTxn{
+		store:    d,
+		snapshot: d.version,
+		readonly: readOnly,
+		ops:      make(map[datastore.Key]op),
+		reads:    make(map[datastore.Key]struct{}),
+	}, nil
+}
+
+// Batch returns a batch applying its writes at once on Commit. Unlike
+// transactions, batches never conflict.
+func (d *TxMapDatastore) Batch() (datastore.Batch, error) {
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		return nil, err
+	}
+	txn.(*txMapTxn).blind = true
+	return txn, nil
+}
+
+func (d *TxMapDatastore) Get(key datastore.Key) ([]byte, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.get(key, d.version)
+}
+
+func (d *TxMapDatastore) Has(key datastore.Key) (bool, error) {
+	_, err := d.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *TxMapDatastore) GetSize(key datastore.Key) (int, error) {
+	v, err := d.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(v), nil
+}
+
+func (d *TxMapDatastore) Query(q query.Query) (query.Results, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return queryEntries(q, d.entries(q.Prefix, d.version, nil)), nil
+}
+
+func (d *TxMapDatastore) Put(key datastore.Key, value []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.commit(map[datastore.Key]op{key: {value: value}})
+}
+
+func (d *TxMapDatastore) Delete(key datastore.Key) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.commit(map[datastore.Key]op{key: {delete: true}})
+}
+
+// Close closes the journal, if any. Writes fail once it's closed.
+func (d *TxMapDatastore) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.Close()
+}
+
+// get returns the value of key at the given version.
+func (d *TxMapDatastore) get(key datastore.Key, version uint64) ([]byte, error) {
+	values := d.values[key]
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i].version > version {
+			continue
+		}
+		if values[i].deleted {
+			break
+		}
+		return values[i].value, nil
+	}
+	return nil, datastore.ErrNotFound
+}
+
+// entries returns the entries of keys with prefix at the given version,
+// with ops applied over them.
+func (d *TxMapDatastore) entries(prefix string, version uint64, ops map[datastore.Key]op) []query.Entry {
+	var entries []query.Entry
+	for k := range d.values {
+		if _, ok := ops[k]; ok || !strings.HasPrefix(k.String(), prefix) {
+			continue
+		}
+		if v, err := d.get(k, version); err == nil {
+			entries = append(entries, query.Entry{Key: k.String(), Value: v})
+		}
+	}
+	for k, op := range ops {
+		if !op.delete && strings.HasPrefix(k.String(), prefix) {
+			entries = append(entries, query.Entry{Key: k.String(), Value: op.value})
+		}
+	}
+	return entries
+}
+
+// commit applies ops as a new version, once they're journaled. Callers
+// must hold the write lock.
+func (d *TxMapDatastore) commit(ops map[datastore.Key]op) error {
+	if d.journal != nil {
+		if err := writeJournal(d.journal, ops); err != nil {
+			return err
+		}
+	}
+	d.apply(ops)
+	return nil
+}
+
+// apply applies ops as a new version. Callers must hold the write lock.
+func (d *TxMapDatastore) apply(ops map[datastore.Key]op) {
+	d.version++
+	c := txMapCommit{version: d.version, keys: make([]datastore.Key, 0, len(ops))}
+	for k, op := range ops {
+		d.values[k] = append(d.values[k], txMapValue{version: d.version, deleted: op.delete, value: op.value})
+		c.keys = append(c.keys, k)
+	}
+	d.commits = append(d.commits, c)
+	d.compact()
+}
+
+// conflicts returns whether keys changed after the snapshot of txn
+// overlap with the ones it read, queried or wrote. Callers must hold
+// the lock.
+func (d *TxMapDatastore) conflicts(txn *txMapTxn) bool {
+	for _, c := range d.commits {
+		if c.version <= txn.snapshot {
+			continue
+		}
+		for _, k := range c.keys {
+			if _, ok := txn.ops[k]; ok {
+				return true
+			}
+			if _, ok := txn.reads[k]; ok {
+				return true
+			}
+			for _, p := range txn.prefixes {
+				if strings.HasPrefix(k.String(), p) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// release closes the snapshot of a transaction. Callers must hold the
+// write lock.
+func (d *TxMapDatastore) release(snapshot uint64) {
+	if d.snapshots[snapshot]--; d.snapshots[snapshot] <= 0 {
+		delete(d.snapshots, snapshot)
+	}
+	d.compact()
+}
+
+// compact drops the commits and versions which no open snapshot can read.
+// Callers must hold the write lock.
+func (d *TxMapDatastore) compact() {
+	oldest := d.version
+	for s := range d.snapshots {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	i := 0
+	for ; i < len(d.commits) && d.commits[i].version <= oldest; i++ {
+		for _, k := range d.commits[i].keys {
+			d.compactKey(k, oldest)
+		}
+	}
+	d.commits = d.commits[i:]
+}
+
+// compactKey drops the versions of key older than the one visible at the
+// oldest open snapshot.
+func (d *TxMapDatastore) compactKey(key datastore.Key, oldest uint64) {
+	values := d.values[key]
+	visible := 0
+	for i, v := range values {
+		if v.version <= oldest {
+			visible = i
+		}
+	}
+	values = values[visible:]
+	if len(values) == 0 || len(values) == 1 && values[0].deleted {
+		delete(d.values, key)
+		return
+	}
+	d.values[key] = values
+}
+
+// txMapTxn is a transaction of a TxMapDatastore.
+type txMapTxn struct {
+	store    *TxMapDatastore
+	snapshot uint64
+	readonly bool
+	// blind transactions are batches, which don't check conflicts
+	blind bool
+
+	lock     sync.Mutex
+	done     bool
+	ops      map[datastore.Key]op
+	reads    map[datastore.Key]struct{}
+	prefixes []string
+}
+
+func (t *txMapTxn) Get(key datastore.Key) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if op, ok := t.ops[key]; ok {
+		if op.delete {
+			return nil, datastore.ErrNotFound
+		}
+		return op.value, nil
+	}
+	t.reads[key] = struct{}{}
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+	return t.store.get(key, t.snapshot)
+}
+
+func (t *txMapTxn) Has(key datastore.Key) (bool, error) {
+	_, err := t.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (t *txMapTxn) GetSize(key datastore.Key) (int, error) {
+	v, err := t.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(v), nil
+}
+
+func (t *txMapTxn) Query(q query.Query) (query.Results, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	t.prefixes = append(t.prefixes, q.Prefix)
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+	return queryEntries(q, t.store.entries(q.Prefix, t.snapshot, t.ops)), nil
+}
+
+func (t *txMapTxn) Put(key datastore.Key, value []byte) error {
+	return t.write(key, op{value: value})
+}
+
+func (t *txMapTxn) Delete(key datastore.Key) error {
+	return t.write(key, op{delete: true})
+}
+
+func (t *txMapTxn) write(key datastore.Key, o op) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.readonly {
+		return ErrReadonlyTx
+	}
+	t.ops[key] = o
+	return nil
+}
+
+// Commit applies the writes of the transaction, unless it conflicts with
+// another one committed after it was created. Either way, the transaction
+// is closed.
+func (t *txMapTxn) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+	defer t.store.release(t.snapshot)
+	if len(t.ops) == 0 {
+		return nil
+	}
+	if !t.blind && t.store.conflicts(t) {
+		return ErrTxnConflict
+	}
+	return t.store.commit(t.ops)
+}
+
+func (t *txMapTxn) Discard() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	t.ops = nil
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+	t.store.release(t.snapshot)
+}
+
+// queryEntries applies q over entries, sorted by key unless q has orders.
+func queryEntries(q query.Query, entries []query.Entry) query.Results {
+	if len(q.Orders) == 0 {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	}
+	if q.KeysOnly {
+		for i := range entries {
+			entries[i].Value = nil
+		}
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries))
+}
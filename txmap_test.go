@@ -0,0 +1,281 @@
+package eventstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+)
+
+func TestTxMapDatastore(t *testing.T) {
+	t.Parallel()
+	d := NewTxMapDatastore()
+	checkErr(t, d.Put(datastore.NewKey("/a"), []byte("1")))
+	checkErr(t, d.Put(datastore.NewKey("/b"), []byte("1")))
+
+	t.Run("Snapshot", func(t *testing.T) {
+		txn, err := d.NewTransaction(true)
+		checkErr(t, err)
+		defer txn.Discard()
+		checkErr(t, d.Put(datastore.NewKey("/a"), []byte("2")))
+		checkErr(t, d.Put(datastore.NewKey("/c"), []byte("2")))
+		assertTxnValue(t, txn, "/a", "1")
+		assertTxnKeys(t, txn, "", "/a", "/b")
+		if err := txn.Put(datastore.NewKey("/a"), nil); err != ErrReadonlyTx {
+			t.Fatalf("expected read only error, got: %v", err)
+		}
+	})
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		txn, err := d.NewTransaction(false)
+		checkErr(t, err)
+		checkErr(t, txn.Put(datastore.NewKey("/d"), []byte("3")))
+		checkErr(t, txn.Delete(datastore.NewKey("/b")))
+		assertTxnValue(t, txn, "/d", "3")
+		if exists, err := txn.Has(datastore.NewKey("/b")); err != nil || exists {
+			t.Fatalf("deleted key shouldn't exist in the transaction, got: %v %v", exists, err)
+		}
+		assertTxnKeys(t, txn, "", "/a", "/c", "/d")
+		assertTxnKeys(t, d, "", "/a", "/b", "/c")
+		checkErr(t, txn.Commit())
+		assertTxnKeys(t, d, "", "/a", "/c", "/d")
+		if err := txn.Put(datastore.NewKey("/e"), nil); err != ErrTxnDone {
+			t.Fatalf("expected done error, got: %v", err)
+		}
+	})
+	t.Run("Discard", func(t *testing.T) {
+		txn, err := d.NewTransaction(false)
+		checkErr(t, err)
+		checkErr(t, txn.Put(datastore.NewKey("/e"), []byte("4")))
+		txn.Discard()
+		txn.Discard()
+		if exists, err := d.Has(datastore.NewKey("/e")); err != nil || exists {
+			t.Fatalf("discarded writes shouldn't be committed, got: %v %v", exists, err)
+		}
+	})
+	t.Run("Conflict", func(t *testing.T) {
+		tests := []struct {
+			name string
+			op   func(txn datastore.Txn) error
+		}{
+			{"Read", func(txn datastore.Txn) error {
+				_, err := txn.Get(datastore.NewKey("/a"))
+				return err
+			}},
+			{"Write", func(txn datastore.Txn) error {
+				return txn.Delete(datastore.NewKey("/a"))
+			}},
+			{"Query", func(txn datastore.Txn) error {
+				_, err := txn.Query(query.Query{Prefix: "/"})
+				return err
+			}},
+		}
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				first, err := d.NewTransaction(false)
+				checkErr(t, err)
+				second, err := d.NewTransaction(false)
+				checkErr(t, err)
+				checkErr(t, tt.op(first))
+				checkErr(t, first.Put(datastore.NewKey("/f"), []byte(tt.name)))
+				checkErr(t, second.Put(datastore.NewKey("/a"), []byte(tt.name)))
+				checkErr(t, second.Commit())
+				if err := first.Commit(); err != ErrTxnConflict {
+					t.Fatalf("expected conflict error, got: %v", err)
+				}
+				if exists, err := d.Has(datastore.NewKey("/f")); err != nil || exists {
+					t.Fatalf("conflicting writes shouldn't be committed, got: %v %v", exists, err)
+				}
+			})
+		}
+
+		// Transactions changing unrelated keys don't conflict
+		first, err := d.NewTransaction(false)
+		checkErr(t, err)
+		second, err := d.NewTransaction(false)
+		checkErr(t, err)
+		assertTxnValue(t, first, "/c", "2")
+		checkErr(t, first.Put(datastore.NewKey("/c"), []byte("5")))
+		checkErr(t, second.Put(datastore.NewKey("/a"), []byte("5")))
+		checkErr(t, second.Commit())
+		checkErr(t, first.Commit())
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		// Concurrent increments retried on conflict are never lost
+		key := datastore.NewKey("/counter")
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := increment(d, key)
+					if err == nil {
+						return
+					}
+					if err != ErrTxnConflict {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assertTxnValue(t, d, "/counter", "10")
+	})
+
+	// Versions no transaction can read are dropped
+	for k, values := range d.values {
+		if len(values) != 1 {
+			t.Fatalf("only the last version of %s should be kept, got %d", k, len(values))
+		}
+	}
+	if len(d.commits) != 0 || len(d.snapshots) != 0 {
+		t.Fatalf("closed transactions should be released, got %d commits and %d snapshots", len(d.commits), len(d.snapshots))
+	}
+}
+
+func TestTxMapDatastoreJournal(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "txmap")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	d, err := OpenTxMapDatastore(path)
+	checkErr(t, err)
+	checkErr(t, d.Put(datastore.NewKey("/a"), []byte("1")))
+	checkErr(t, d.Put(datastore.NewKey("/b"), []byte("1")))
+	checkErr(t, d.Delete(datastore.NewKey("/b")))
+	txn, err := d.NewTransaction(false)
+	checkErr(t, err)
+	checkErr(t, txn.Put(datastore.NewKey("/a"), []byte("2")))
+	checkErr(t, txn.Put(datastore.NewKey("/c"), []byte("2")))
+	checkErr(t, txn.Commit())
+	txn, err = d.NewTransaction(false)
+	checkErr(t, err)
+	checkErr(t, txn.Put(datastore.NewKey("/d"), []byte("2")))
+	txn.Discard()
+	checkErr(t, d.Close())
+
+	d, err = OpenTxMapDatastore(path)
+	checkErr(t, err)
+	assertTxnValue(t, d, "/a", "2")
+	assertTxnKeys(t, d, "", "/a", "/c")
+	checkErr(t, d.Close())
+
+	t.Run("TornCommit", func(t *testing.T) {
+		// A commit interrupted by a crash is discarded
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		checkErr(t, err)
+		_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+		checkErr(t, err)
+		checkErr(t, f.Close())
+		d, err := OpenTxMapDatastore(path)
+		checkErr(t, err)
+		assertTxnKeys(t, d, "", "/a", "/c")
+		checkErr(t, d.Put(datastore.NewKey("/e"), []byte("3")))
+		checkErr(t, d.Close())
+		d, err = OpenTxMapDatastore(path)
+		checkErr(t, err)
+		assertTxnKeys(t, d, "", "/a", "/c", "/e")
+		checkErr(t, d.Close())
+	})
+	t.Run("Dispatcher", func(t *testing.T) {
+		d, err := OpenTxMapDatastore(filepath.Join(dir, "log"))
+		checkErr(t, err)
+		checkErr(t, NewDispatcher(d).Dispatch(&testEvent{Timestamp: time.Now(), ID: core.NewEntityID(), TypeName: "type"}))
+		checkErr(t, d.Close())
+		d, err = OpenTxMapDatastore(filepath.Join(dir, "log"))
+		checkErr(t, err)
+		defer d.Close()
+		dispatcher := NewDispatcher(d)
+		checkErr(t, dispatcher.Verify())
+		if last, err := dispatcher.LastSeq(); err != nil || last != 1 {
+			t.Fatalf("expected the persisted event, got: %d %v", last, err)
+		}
+	})
+}
+
+func TestSimpleTxRollback(t *testing.T) {
+	t.Parallel()
+	target := &failingDatastore{Datastore: datastore.NewMapDatastore(), fail: datastore.NewKey("/c")}
+	checkErr(t, target.Put(datastore.NewKey("/a"), []byte("1")))
+	txn := NewSimpleTx(target)
+	checkErr(t, txn.Put(datastore.NewKey("/a"), []byte("2")))
+	checkErr(t, txn.Put(datastore.NewKey("/b"), []byte("2")))
+	checkErr(t, txn.Put(datastore.NewKey("/c"), []byte("2")))
+	if err := txn.Commit(); err != errPutFailed {
+		t.Fatalf("expected put error, got: %v", err)
+	}
+	assertTxnValue(t, target, "/a", "1")
+	assertTxnKeys(t, target, "", "/a")
+}
+
+var errPutFailed = errors.New("put failed")
+
+// failingDatastore fails to put the fail key.
+type failingDatastore struct {
+	datastore.Datastore
+	fail datastore.Key
+}
+
+func (d *failingDatastore) Put(key datastore.Key, value []byte) error {
+	if key == d.fail {
+		return errPutFailed
+	}
+	return d.Datastore.Put(key, value)
+}
+
+func increment(d datastore.TxnDatastore, key datastore.Key) error {
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	var n int
+	if b, err := txn.Get(key); err == nil {
+		if _, err := fmt.Sscan(string(b), &n); err != nil {
+			return err
+		}
+	} else if err != datastore.ErrNotFound {
+		return err
+	}
+	if err := txn.Put(key, []byte(fmt.Sprint(n+1))); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func assertTxnValue(t *testing.T, r datastore.Read, key, expected string) {
+	t.Helper()
+	v, err := r.Get(datastore.NewKey(key))
+	checkErr(t, err)
+	if string(v) != expected {
+		t.Fatalf("expected %s to be %q, got %q", key, expected, v)
+	}
+}
+
+func assertTxnKeys(t *testing.T, r datastore.Read, prefix string, expected ...string) {
+	t.Helper()
+	res, err := r.Query(query.Query{Prefix: prefix, KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}})
+	checkErr(t, err)
+	entries, err := res.Rest()
+	checkErr(t, err)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+}
@@ -0,0 +1,185 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+)
+
+func TestReplayV1Log(t *testing.T) {
+	t.Parallel()
+	// Events as encoded before operations were versioned, with base64 patches
+	id := core.NewEntityID()
+	deleteID := core.NewEventID()
+	now := time.Now()
+	v1 := []string{
+		`{"Type":0,"EntityID":"` + id.String() + `","JSONPatch":"eyJJRCI6IiIsIk5hbWUiOiJGb28iLCJBZ2UiOjQyfQ=="}`,
+		`{"Type":1,"EntityID":"` + id.String() + `","JSONPatch":"eyJBZ2UiOjQzfQ=="}`,
+		`{"Type":2,"EntityID":"` + id.String() + `","JSONPatch":null,"Undo":"eyJJRCI6IiIsIk5hbWUiOiJGb28iLCJBZ2UiOjQzfQ=="}`,
+	}
+	s := createTestStore()
+	events := make([]core.Event, len(v1))
+	for i, body := range v1 {
+		events[i] = &testEvent{
+			Timestamp: now.Add(time.Duration(i)),
+			ID:        id,
+			TypeName:  "#/definitions/Person",
+			Payload:   []byte(body),
+		}
+	}
+	events[2].(*testEvent).Meta.EventID = deleteID
+	checkErr(t, s.dispatcher.DispatchBatch(events[:2]))
+
+	// Registering the model replays the old log
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+	var p Person
+	checkErr(t, m.FindByID(id, &p))
+	if p.Name != "Foo" || p.Age != 43 {
+		t.Fatalf("old events should be replayed, got %+v", p)
+	}
+
+	_, err = s.DispatchBatch(events[2:])
+	checkErr(t, err)
+	if exists, err := m.Has(id); err != nil || exists {
+		t.Fatalf("instance should be deleted, got: %v %v", exists, err)
+	}
+	checkErr(t, m.Revert(deleteID))
+	checkErr(t, m.FindByID(id, &p))
+	if p.Name != "Foo" || p.Age != 43 {
+		t.Fatalf("old delete should be reverted, got %+v", p)
+	}
+
+	t.Run("UnknownVersion", func(t *testing.T) {
+		future := &testEvent{
+			Timestamp: now.Add(time.Hour),
+			ID:        core.NewEntityID(),
+			TypeName:  "#/definitions/Person",
+			Payload:   []byte(`{"Version":99,"Type":0,"JSONPatch":{}}`),
+		}
+		if _, err := s.Dispatch(future); !errors.Is(err, core.ErrUnknownVersion) {
+			t.Fatalf("expected unknown version error, got: %v", err)
+		}
+	})
+}
+
+func TestReplayBaselineLog(t *testing.T) {
+	t.Parallel()
+	// Events as persisted before the log was hash-linked, with their
+	// instance as reduced by then
+	id := core.NewEntityID()
+	now := time.Now()
+	log := NewTxMapDatastore()
+	putBaselineEvents(t, log,
+		baselineEvent{
+			Timestamp: now,
+			ID:        id,
+			TypeName:  "#/definitions/Person",
+			Patch:     []byte(`{"Type":0,"EntityID":"` + id.String() + `","JSONPatch":"eyJJRCI6IiIsIk5hbWUiOiJGb28iLCJBZ2UiOjQyfQ=="}`),
+		},
+		baselineEvent{
+			Timestamp: now.Add(time.Second),
+			ID:        id,
+			TypeName:  "#/definitions/Person",
+			Patch:     []byte(`{"Type":1,"EntityID":"` + id.String() + `","JSONPatch":"eyJBZ2UiOjQzfQ=="}`),
+		},
+	)
+	instances := dssync.MutexWrap(datastore.NewMapDatastore())
+	instance := []byte(`{"ID":"` + id.String() + `","Name":"Foo","Age":43}`)
+	checkErr(t, instances.Put(baseKey.ChildString("Person").ChildString(id.String()), instance))
+
+	// The log is migrated, and its events aren't reduced again
+	s := NewStore(instances, NewDispatcher(log), jsonpatcher.New())
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+	assertPersonInModel(t, m, &Person{ID: id, Name: "Foo", Age: 43})
+	checkErr(t, s.dispatcher.Verify())
+
+	// The migrated events are replayed by other stores
+	entries, err := s.dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 migrated events, got %d", len(entries))
+	}
+	target := createTestStore()
+	tm, err := target.Register("Person", &Person{})
+	checkErr(t, err)
+	for _, e := range entries {
+		_, err := target.Dispatch(e.Event)
+		checkErr(t, err)
+	}
+	var p Person
+	checkErr(t, tm.FindByID(id, &p))
+	if p.Name != "Foo" || p.Age != 43 {
+		t.Fatalf("baseline events should be replayed, got %+v", p)
+	}
+
+	// New events follow the migrated ones
+	saved := &Person{ID: id, Name: "Foo", Age: 44}
+	checkErr(t, m.Save(saved))
+	assertPersonInModel(t, m, saved)
+	checkErr(t, NewDispatcher(log).Verify())
+}
+
+type bookBorrowedV2 struct {
+	Borrower string
+}
+
+func TestDomainEventUpcasting(t *testing.T) {
+	t.Parallel()
+	source := createTestStore()
+	sm := registerLoans(t, source)
+	b := &loanedBook{Title: "Title1"}
+	checkErr(t, sm.Create(b))
+	checkErr(t, sm.Execute(b.ID, borrowBook{UserID: "alice"}))
+
+	// A newer version of the application renamed the borrower field
+	target := createTestStore()
+	tm, err := target.Register("Book", &loanedBook{},
+		WithEvent("BookBorrowed", &bookBorrowedV2{}, func(instance, event interface{}) error {
+			instance.(*loanedBook).BorrowedBy = event.(*bookBorrowedV2).Borrower
+			return nil
+		}),
+		WithEventUpcaster("BookBorrowed", 1, func(body []byte) ([]byte, error) {
+			var v1 bookBorrowed
+			if err := json.Unmarshal(body, &v1); err != nil {
+				return nil, err
+			}
+			return json.Marshal(bookBorrowedV2{Borrower: v1.UserID})
+		}),
+	)
+	checkErr(t, err)
+	entries, err := source.dispatcher.Events(context.Background(), 0, 0, nil)
+	checkErr(t, err)
+	for _, e := range entries {
+		_, err := target.Dispatch(e.Event)
+		checkErr(t, err)
+	}
+	var replayed loanedBook
+	checkErr(t, tm.FindByID(b.ID, &replayed))
+	if replayed.BorrowedBy != "alice" {
+		t.Fatalf("old domain events should be upcasted, got %+v", replayed)
+	}
+
+	checkErr(t, tm.WriteTxn(func(txn *Txn) error {
+		return txn.Emit(b.ID, bookBorrowedV2{Borrower: "bob"})
+	}))
+	events := modelEvents(t, target, tm)
+	if typ := events[len(events)-1].Type(); typ != tm.schema.Ref+"/BookBorrowed@2" {
+		t.Fatalf("new domain events should have the latest version, got %s", typ)
+	}
+	assertLoanedBook(t, tm, b.ID, "bob", 0)
+
+	// Older applications can't decode newer events
+	_, err = source.Dispatch(events[len(events)-1])
+	if !errors.Is(err, core.ErrUnknownVersion) {
+		t.Fatalf("expected unknown version error, got: %v", err)
+	}
+}
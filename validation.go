@@ -0,0 +1,301 @@
+package eventstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-eventstore/core"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var (
+	quarantinePrefix = ds.NewKey("/quarantine")
+
+	// ErrInvalidEvent indicates an event which can't be applied to its
+	// instance, or leaves it not corresponding to the model schema
+	ErrInvalidEvent = errors.New("invalid event")
+	// ErrQuarantinedNotFound indicates there's no quarantined event with the given key
+	ErrQuarantinedNotFound = errors.New("quarantined event not found")
+)
+
+// WithQuarantine makes the store quarantine invalid external events
+// instead of rejecting the whole batch they're dispatched with. They're
+// reported with the Quarantined status, and kept aside until they're
+// released or discarded.
+func WithQuarantine() StoreOption {
+	return func(store *Store) {
+		store.quarantine = true
+	}
+}
+
+// QuarantinedEvent is an external event which was invalid for its model.
+type QuarantinedEvent struct {
+	// Key identifies the event, as in the event log
+	Key ds.Key
+	// Event is the quarantined event
+	Event core.Event
+	// Error is why the event is invalid
+	Error string
+	// Time is when the event was quarantined
+	Time time.Time
+}
+
+// quarantined is the persisted form of a QuarantinedEvent.
+type quarantined struct {
+	Record []byte
+	Error  string
+	Time   time.Time
+}
+
+// Quarantined returns the quarantined events.
+func (s *Store) Quarantined() ([]QuarantinedEvent, error) {
+	res, err := s.dispatcher.store.Query(query.Query{
+		Prefix: quarantinePrefix.String() + "/",
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]QuarantinedEvent, len(entries))
+	for i, e := range entries {
+		key := ds.RawKey(strings.TrimPrefix(e.Key, quarantinePrefix.String()))
+		if events[i], err = decodeQuarantined(key, e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// ReleaseQuarantined dispatches again a quarantined event, e.g. once the
+// instance it updates is received. It's removed from the quarantine if
+// it's valid now.
+func (s *Store) ReleaseQuarantined(key ds.Key) (DispatchStatus, error) {
+	b, err := s.dispatcher.store.Get(quarantinePrefix.Child(key))
+	if err == ds.ErrNotFound {
+		return Rejected, ErrQuarantinedNotFound
+	}
+	if err != nil {
+		return Rejected, err
+	}
+	q, err := decodeQuarantined(key, b)
+	if err != nil {
+		return Rejected, err
+	}
+	status, err := s.Dispatch(q.Event)
+	if status == Rejected || status == Quarantined {
+		return status, err
+	}
+	// Persisted events leave the quarantine, even if reducing them failed
+	if derr := s.dispatcher.store.Delete(quarantinePrefix.Child(key)); derr != nil && err == nil {
+		err = derr
+	}
+	return status, err
+}
+
+// DiscardQuarantined removes a quarantined event without dispatching it.
+func (s *Store) DiscardQuarantined(key ds.Key) error {
+	exists, err := s.dispatcher.store.Has(quarantinePrefix.Child(key))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrQuarantinedNotFound
+	}
+	return s.dispatcher.store.Delete(quarantinePrefix.Child(key))
+}
+
+func (s *Store) putQuarantined(event core.Event, reason error) error {
+	rec, _, err := encodeRecord(s.dispatcher.encoding, record{Event: newLoggedEvent(event)})
+	if err != nil {
+		return err
+	}
+	b := bytes.Buffer{}
+	q := quarantined{Record: rec, Error: reason.Error(), Time: time.Now()}
+	if err := gob.NewEncoder(&b).Encode(q); err != nil {
+		return err
+	}
+	return s.dispatcher.store.Put(quarantinePrefix.Child(eventKey(event)), b.Bytes())
+}
+
+func decodeQuarantined(key ds.Key, b []byte) (QuarantinedEvent, error) {
+	var q quarantined
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&q); err != nil {
+		return QuarantinedEvent{}, err
+	}
+	rec, _, err := decodeRecord(q.Record)
+	if err != nil {
+		return QuarantinedEvent{}, err
+	}
+	return QuarantinedEvent{Key: key, Event: &rec.Event, Error: q.Error, Time: q.Time}, nil
+}
+
+// validateBatch returns, for each event, why it's invalid for its model or
+// nil. Events are applied in order over the current instances, as they'd
+// be reduced, and the resulting instances are validated against the
+// model schema. Concurrent events must apply over the current instances
+// too, and the instances resolving them are validated. Events of
+// unregistered models, already persisted, or already seen by their
+// instance aren't validated.
+func (s *Store) validateBatch(events []core.Event) ([]error, error) {
+	var models []*Model
+	for _, e := range events {
+		if m := s.modelFor(e.Type()); m != nil {
+			models = append(models, m)
+		}
+	}
+	if err := s.waitReduced(models...); err != nil {
+		return nil, err
+	}
+	v := batchValidation{
+		instances: make(map[ds.Key][]byte),
+		versions:  make(map[ds.Key]entityVersion),
+	}
+	errs := make([]error, len(events))
+	for i, e := range events {
+		m := s.modelFor(e.Type())
+		if m == nil {
+			continue
+		}
+		seq, err := s.dispatcher.persistedSeq(eventsPrefix.Child(eventKey(e)), e.Metadata().EventID)
+		if err != nil {
+			return nil, err
+		}
+		if seq != 0 {
+			continue
+		}
+		if errs[i], err = v.validate(m, e); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// batchValidation holds the instances and versions as left by the
+// validated events of a batch.
+type batchValidation struct {
+	instances map[ds.Key][]byte
+	versions  map[ds.Key]entityVersion
+}
+
+// validate returns why event is invalid for m, or a nil reason. Valid
+// events are applied to the batch instances.
+func (v batchValidation) validate(m *Model, event core.Event) (reason error, err error) {
+	key := m.dsKey.ChildString(event.EntityID().String())
+	local, ok := v.instances[key]
+	if !ok {
+		if local, err = m.datastore.Get(key); err != nil && err != ds.ErrNotFound {
+			return nil, err
+		}
+	}
+	versioned := len(event.Metadata().Version) > 0
+	current, ok := v.versions[key]
+	if !ok && versioned {
+		if current, err = m.loadVersion(m.datastore, m.dsKey, event.EntityID()); err != nil {
+			return nil, err
+		}
+	}
+	var causality core.Causality
+	if versioned {
+		causality = current.Clock.Compare(event.Metadata().Version)
+		if causality == core.After || causality == core.Equal {
+			return nil, nil
+		}
+	}
+
+	var instance []byte
+	if causality == core.Concurrent {
+		if instance, err = m.resolveConflict(event, local, current); err != nil {
+			if errors.Is(err, ErrInvalidEvent) {
+				return err, nil
+			}
+			return fmt.Errorf("%w: conflict can't be resolved: %v", ErrInvalidEvent, err), nil
+		}
+	} else if instance, err = m.apply(event, local); err != nil {
+		return &applyError{err: err}, nil
+	}
+	if instance != nil {
+		if reason := m.validateJSON(instance); reason != nil {
+			return reason, nil
+		}
+	}
+	v.instances[key] = instance
+	if versioned {
+		v.versions[key] = current.next(event)
+	}
+	return nil, nil
+}
+
+// applyError is an ErrInvalidEvent caused by err when applying the event.
+type applyError struct {
+	err error
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("%v: can't be applied: %v", ErrInvalidEvent, e.err)
+}
+
+func (e *applyError) Is(target error) bool {
+	return target == ErrInvalidEvent
+}
+
+func (e *applyError) Unwrap() error {
+	return e.err
+}
+
+// apply returns the JSON encoded instance as event leaves it applied over
+// local, or nil if it deletes it. Instances are left untouched.
+func (m *Model) apply(event core.Event, local []byte) ([]byte, error) {
+	key := m.dsKey.ChildString(event.EntityID().String())
+	scratch := NewSimpleTx(ds.NewMapDatastore())
+	if local != nil {
+		if err := scratch.Put(key, local); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.reduceInto(event, scratch, m.dsKey); err != nil {
+		return nil, err
+	}
+	b, err := scratch.Get(key)
+	if err == ds.ErrNotFound {
+		return nil, nil
+	}
+	return b, err
+}
+
+// validateJSON checks the JSON encoded instance b against the model schema.
+func (m *Model) validateJSON(b []byte) error {
+	r, err := gojsonschema.Validate(m.schemaLoader, gojsonschema.NewBytesLoader(b))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+	if r.Valid() {
+		return nil
+	}
+	details := make([]string, len(r.Errors()))
+	for i, e := range r.Errors() {
+		details[i] = e.String()
+	}
+	return fmt.Errorf("%w: %s: %s", ErrInvalidEvent, ErrInvalidSchemaInstance, strings.Join(details, "; "))
+}
+
+// modelFor returns the registered model of events with type t, or nil.
+func (s *Store) modelFor(t string) *Model {
+	s.modelsLock.RLock()
+	defer s.modelsLock.RUnlock()
+	for _, m := range s.models {
+		if m.handles(t) {
+			return m
+		}
+	}
+	return nil
+}
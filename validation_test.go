@@ -0,0 +1,164 @@
+package eventstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/textileio/go-eventstore/core"
+	"github.com/textileio/go-eventstore/jsonpatcher"
+)
+
+func TestValidateRemoteEvents(t *testing.T) {
+	t.Parallel()
+	s := createTestStore()
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+
+	valid := createRemoteEvent(t, m, core.Create, core.NewEntityID(), map[string]interface{}{"Name": "Foo", "Age": 42})
+	invalid := createRemoteEvent(t, m, core.Create, core.NewEntityID(), map[string]interface{}{"Name": "Bar", "Age": "old"})
+	_, err = s.DispatchBatch([]core.Event{valid, invalid})
+	if !errors.Is(err, ErrInvalidEvent) {
+		t.Fatalf("expected invalid event error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Age") {
+		t.Fatalf("error should describe the invalid field, got: %v", err)
+	}
+	seq, err := s.dispatcher.LastSeq()
+	checkErr(t, err)
+	if seq != 0 {
+		t.Fatalf("no event of the batch should be dispatched, got %d", seq)
+	}
+	if exists, err := m.Has(valid.EntityID()); err != nil || exists {
+		t.Fatalf("instance shouldn't be created, got: %v %v", exists, err)
+	}
+
+	t.Run("SaveUnknown", func(t *testing.T) {
+		save := createRemoteEvent(t, m, core.Save, core.NewEntityID(), map[string]interface{}{"Name": "Baz", "Age": 44})
+		if _, err := s.Dispatch(save); !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("expected invalid event error, got: %v", err)
+		}
+	})
+	t.Run("Batch", func(t *testing.T) {
+		// Events are validated over the instances left by previous ones in the batch
+		id := core.NewEntityID()
+		create := createRemoteEvent(t, m, core.Create, id, map[string]interface{}{"Name": "Baz", "Age": 44})
+		save := createRemoteEvent(t, m, core.Save, id, map[string]interface{}{"Name": "Baz", "Age": 45})
+		statuses, err := s.DispatchBatch([]core.Event{create, save})
+		checkErr(t, err)
+		if statuses[0] != Dispatched || statuses[1] != Dispatched {
+			t.Fatalf("expected dispatched statuses, got %v", statuses)
+		}
+		assertPersonInModel(t, m, &Person{ID: id, Name: "Baz", Age: 45})
+	})
+}
+
+func TestValidateConcurrentEvents(t *testing.T) {
+	t.Parallel()
+	t.Run("Unappliable", func(t *testing.T) {
+		t.Parallel()
+		s := createTestStore(WithReplicaID("b"))
+		m, err := s.Register("Person", &Person{})
+		checkErr(t, err)
+		p := &Person{Name: "Foo", Age: 42}
+		checkErr(t, m.Create(p))
+
+		create := createVersionedEvent(t, m, core.Create, p.ID, map[string]interface{}{"Name": "Bar", "Age": 1}, core.VectorClock{"a": 1})
+		if _, err := s.Dispatch(create); !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("expected invalid event error, got: %v", err)
+		}
+		assertPersonInModel(t, m, p)
+	})
+	t.Run("InvalidResolution", func(t *testing.T) {
+		t.Parallel()
+		s := createTestStore(WithReplicaID("b"))
+		resolver := func(c Conflict) ([]byte, error) {
+			return []byte(`{"ID":"` + c.EntityID.String() + `","Name":"Foo","Age":"old"}`), nil
+		}
+		m, err := s.Register("Person", &Person{}, WithConflictResolver(resolver))
+		checkErr(t, err)
+		p := &Person{Name: "Foo", Age: 42}
+		checkErr(t, m.Create(p))
+
+		save := createVersionedEvent(t, m, core.Save, p.ID, map[string]interface{}{"Name": "Foo", "Age": 43}, core.VectorClock{"a": 1})
+		if _, err := s.Dispatch(save); !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("expected invalid event error, got: %v", err)
+		}
+		assertPersonInModel(t, m, p)
+	})
+}
+
+func TestQuarantine(t *testing.T) {
+	t.Parallel()
+	s := createTestStore(WithQuarantine())
+	m, err := s.Register("Person", &Person{})
+	checkErr(t, err)
+
+	id := core.NewEntityID()
+	create := createRemoteEvent(t, m, core.Create, id, map[string]interface{}{"Name": "Foo", "Age": 42})
+	invalid := createRemoteEvent(t, m, core.Create, core.NewEntityID(), map[string]interface{}{"Name": "Bar", "Age": "old"})
+	save := createRemoteEvent(t, m, core.Save, id, map[string]interface{}{"Name": "Foo", "Age": 43})
+	statuses, err := s.DispatchBatch([]core.Event{invalid, save})
+	checkErr(t, err)
+	if statuses[0] != Quarantined || statuses[1] != Quarantined {
+		t.Fatalf("expected quarantined statuses, got %v", statuses)
+	}
+	quarantined, err := s.Quarantined()
+	checkErr(t, err)
+	if len(quarantined) != 2 {
+		t.Fatalf("expected 2 quarantined events, got %d", len(quarantined))
+	}
+
+	// Once the instance is received, the update can be released
+	status, err := s.Dispatch(create)
+	checkErr(t, err)
+	if status != Dispatched {
+		t.Fatalf("expected dispatched status, got %s", status)
+	}
+	for _, q := range quarantined {
+		if q.Event.EntityID() != id {
+			continue
+		}
+		status, err := s.ReleaseQuarantined(q.Key)
+		checkErr(t, err)
+		if status != Dispatched {
+			t.Fatalf("expected dispatched status, got %s", status)
+		}
+	}
+	assertPersonInModel(t, m, &Person{ID: id, Name: "Foo", Age: 43})
+
+	quarantined, err = s.Quarantined()
+	checkErr(t, err)
+	if len(quarantined) != 1 || quarantined[0].Event.EntityID() != invalid.EntityID() || quarantined[0].Error == "" {
+		t.Fatalf("expected the invalid event quarantined, got %v", quarantined)
+	}
+	status, err = s.ReleaseQuarantined(quarantined[0].Key)
+	checkErr(t, err)
+	if status != Quarantined {
+		t.Fatalf("invalid event should stay quarantined, got %s", status)
+	}
+	checkErr(t, s.DiscardQuarantined(quarantined[0].Key))
+	if err := s.DiscardQuarantined(quarantined[0].Key); err != ErrQuarantinedNotFound {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+// createRemoteEvent returns an event of m for id, as created by another store.
+func createRemoteEvent(t *testing.T, m *Model, typ core.ActionType, id core.EntityID, v map[string]interface{}) core.Event {
+	t.Helper()
+	return createVersionedEvent(t, m, typ, id, v, nil)
+}
+
+// createVersionedEvent is like createRemoteEvent, but the event carries version.
+func createVersionedEvent(t *testing.T, m *Model, typ core.ActionType, id core.EntityID, v map[string]interface{}, version core.VectorClock) core.Event {
+	t.Helper()
+	v["ID"] = id
+	a := core.Action{Type: typ, EntityID: id, EntityType: m.schema.Ref, Current: v}
+	a.Metadata.Version = version
+	if typ == core.Save {
+		a.Previous = map[string]interface{}{}
+	}
+	events, err := jsonpatcher.New().Create([]core.Action{a})
+	checkErr(t, err)
+	return events[0]
+}